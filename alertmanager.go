@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Matcher is a label matcher as understood by the Alertmanager v2 API.
+type Matcher struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	IsRegex bool   `json:"isRegex"`
+	IsEqual bool   `json:"isEqual"`
+}
+
+// UnmarshalJSON defaults isEqual to true, older Alertmanager versions don't send it.
+func (m *Matcher) UnmarshalJSON(data []byte) error {
+	type matcher Matcher
+	res := matcher{IsEqual: true}
+	if err := json.Unmarshal(data, &res); err != nil {
+		return err
+	}
+	*m = Matcher(res)
+	return nil
+}
+
+// Silence is a silence as sent to and returned by the Alertmanager v2 API.
+type Silence struct {
+	ID        string    `json:"id,omitempty"`
+	Matchers  []Matcher `json:"matchers"`
+	StartsAt  time.Time `json:"startsAt"`
+	EndsAt    time.Time `json:"endsAt"`
+	CreatedBy string    `json:"createdBy"`
+	Comment   string    `json:"comment"`
+	Status    *struct {
+		State string `json:"state"`
+	} `json:"status,omitempty"`
+}
+
+var alertmanagerClient = &http.Client{Timeout: 10 * time.Second}
+
+// equalMatchers builds sorted equality matchers from a label set.
+func equalMatchers(labels map[string]string) []Matcher {
+	matchers := make([]Matcher, 0, len(labels))
+	for name, value := range labels {
+		matchers = append(matchers, Matcher{Name: name, Value: value, IsEqual: true})
+	}
+	sort.Slice(matchers, func(i, j int) bool {
+		return matchers[i].Name < matchers[j].Name
+	})
+	return matchers
+}
+
+// alertmanagerRequest calls the Alertmanager API and decodes the JSON answer into out.
+func alertmanagerRequest(method string, apiPath string, body interface{}, out interface{}) error {
+	cfg := current().cfg
+	if cfg.Alertmanager.URL == "" {
+		return fmt.Errorf("alertmanager url is not configured")
+	}
+
+	var reqBody io.Reader
+	if body != nil {
+		content, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(content)
+	}
+
+	req, err := http.NewRequest(method, strings.TrimRight(cfg.Alertmanager.URL, "/")+apiPath, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if cfg.Alertmanager.BearerToken != "" {
+		req.Header.Set("Authorization", "Bearer "+cfg.Alertmanager.BearerToken)
+	} else if cfg.Alertmanager.Username != "" {
+		req.SetBasicAuth(cfg.Alertmanager.Username, cfg.Alertmanager.Password)
+	}
+
+	resp, err := alertmanagerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	content, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("alertmanager %s %s: %s: %s", method, apiPath, resp.Status, strings.TrimSpace(string(content)))
+	}
+	if out == nil || len(content) == 0 {
+		return nil
+	}
+	return json.Unmarshal(content, out)
+}
+
+// createSilence creates a silence in Alertmanager and returns its ID.
+func createSilence(silence Silence) (string, error) {
+	var resp struct {
+		SilenceID string `json:"silenceID"`
+	}
+	err := alertmanagerRequest(http.MethodPost, "/api/v2/silences", silence, &resp)
+	return resp.SilenceID, err
+}
+
+// GettableAlert is an alert as returned by the Alertmanager v2 API.
+type GettableAlert struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	Fingerprint  string            `json:"fingerprint"`
+	GeneratorURL string            `json:"generatorURL"`
+	Status       struct {
+		State       string   `json:"state"`
+		SilencedBy  []string `json:"silencedBy"`
+		InhibitedBy []string `json:"inhibitedBy"`
+	} `json:"status"`
+}
+
+// listAlerts returns the firing alerts that are neither silenced nor inhibited.
+func listAlerts() ([]GettableAlert, error) {
+	var alerts []GettableAlert
+	err := alertmanagerRequest(http.MethodGet, "/api/v2/alerts?active=true&silenced=false&inhibited=false", nil, &alerts)
+	return alerts, err
+}
+
+// listSilencedAlerts returns the alerts suppressed by silences.
+func listSilencedAlerts() ([]GettableAlert, error) {
+	var alerts []GettableAlert
+	err := alertmanagerRequest(http.MethodGet, "/api/v2/alerts?active=false&silenced=true&inhibited=false", nil, &alerts)
+	return alerts, err
+}
+
+// listSilences returns the active silences.
+func listSilences() ([]Silence, error) {
+	var silences []Silence
+	if err := alertmanagerRequest(http.MethodGet, "/api/v2/silences", nil, &silences); err != nil {
+		return nil, err
+	}
+
+	active := silences[:0]
+	for _, s := range silences {
+		if s.Status != nil && s.Status.State == "active" {
+			active = append(active, s)
+		}
+	}
+	return active, nil
+}
+
+// deleteSilence expires a silence.
+func deleteSilence(id string) error {
+	return alertmanagerRequest(http.MethodDelete, "/api/v2/silence/"+url.PathEscape(id), nil, nil)
+}
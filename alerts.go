@@ -0,0 +1,69 @@
+package main
+
+import (
+	"time"
+)
+
+// Alerts is the Alertmanager webhook payload, version 4, of an alert group.
+type Alerts struct {
+	Version  string `json:"version"`
+	GroupKey string `json:"groupKey"`
+	// Alerts left out of the webhook because of max_alerts in Alertmanager
+	TruncatedAlerts   int               `json:"truncatedAlerts"`
+	Status            string            `json:"status"`
+	Receiver          string            `json:"receiver"`
+	GroupLabels       map[string]string `json:"groupLabels"`
+	CommonLabels      map[string]string `json:"commonLabels"`
+	CommonAnnotations map[string]string `json:"commonAnnotations"`
+	ExternalURL       string            `json:"externalURL"`
+	Alerts            []Alert           `json:"alerts"`
+}
+
+// Alert is a single alert of the group.
+type Alert struct {
+	Status       string            `json:"status"`
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     time.Time         `json:"startsAt"`
+	EndsAt       time.Time         `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+	Fingerprint  string            `json:"fingerprint"`
+}
+
+// Firing returns the firing alerts of the group, for templates.
+func (a Alerts) Firing() []Alert {
+	return a.withStatus("firing")
+}
+
+// Resolved returns the resolved alerts of the group, for templates.
+func (a Alerts) Resolved() []Alert {
+	return a.withStatus("resolved")
+}
+
+func (a Alerts) withStatus(status string) []Alert {
+	var alerts []Alert
+	for _, alert := range a.Alerts {
+		if alert.Status == status {
+			alerts = append(alerts, alert)
+		}
+	}
+	return alerts
+}
+
+// Duration is how long the alert fired, until now when it is still firing.
+func (a Alert) Duration() time.Duration {
+	end := time.Now()
+	if a.Status == "resolved" && !a.EndsAt.IsZero() {
+		end = a.EndsAt
+	}
+	return end.Sub(a.StartsAt).Round(time.Second)
+}
+
+// fingerprint identifies the alert, by the fingerprint Alertmanager sends or
+// else by its labels.
+func (a Alert) fingerprint() string {
+	if a.Fingerprint != "" {
+		return a.Fingerprint
+	}
+	return labelsFingerprint(a.Labels)
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDecodeAlertmanager(t *testing.T) {
+	file, err := os.Open(filepath.Join("testdata", "alertmanager_v4.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	alerts, err := decodeAlertmanager(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if problems := validateAlerts(alerts); len(problems) > 0 {
+		t.Errorf("validateAlerts() = %v", problems)
+	}
+
+	if alerts.Version != "4" || alerts.GroupKey != `{}/{severity="critical"}:{alertname="DiskFull"}` || alerts.TruncatedAlerts != 2 {
+		t.Errorf("version, groupKey, truncatedAlerts = %s %s %d", alerts.Version, alerts.GroupKey, alerts.TruncatedAlerts)
+	}
+	if alerts.Receiver != "oncall" || alerts.ExternalURL != "http://alertmanager:9093" || alerts.CommonLabels["severity"] != "critical" {
+		t.Errorf("receiver, externalURL, commonLabels = %s %s %v", alerts.Receiver, alerts.ExternalURL, alerts.CommonLabels)
+	}
+
+	firing, resolved := alerts.Firing(), alerts.Resolved()
+	if len(firing) != 1 || firing[0].Labels["instance"] != "node-1:9100" {
+		t.Errorf("Firing() = %+v", firing)
+	}
+	if len(resolved) != 1 || resolved[0].Labels["instance"] != "node-2:9100" {
+		t.Errorf("Resolved() = %+v", resolved)
+	}
+
+	started := time.Date(2024, 3, 10, 13, 5, 0, 123e6, time.UTC)
+	if !firing[0].StartsAt.Equal(started) || !firing[0].EndsAt.IsZero() {
+		t.Errorf("firing startsAt, endsAt = %v %v, want %v and zero", firing[0].StartsAt, firing[0].EndsAt, started)
+	}
+	if got := resolved[0].Duration(); got != 90*time.Minute+15*time.Second {
+		t.Errorf("resolved Duration() = %v, want 1h30m15s", got)
+	}
+	if got := firing[0].fingerprint(); got != "7f4a8c2e1b3d5a69" {
+		t.Errorf("fingerprint() = %s, want the one of Alertmanager", got)
+	}
+}
+
+func TestAlertDuration(t *testing.T) {
+	start := time.Now().Add(-time.Hour)
+	tests := []struct {
+		name  string
+		alert Alert
+		want  time.Duration
+	}{
+		{name: "firing", alert: Alert{Status: "firing", StartsAt: start}, want: time.Hour},
+		{name: "firing with endsAt", alert: Alert{Status: "firing", StartsAt: start, EndsAt: start.Add(time.Minute)}, want: time.Hour},
+		{name: "resolved", alert: Alert{Status: "resolved", StartsAt: start, EndsAt: start.Add(time.Minute)}, want: time.Minute},
+		{name: "resolved without endsAt", alert: Alert{Status: "resolved", StartsAt: start}, want: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.alert.Duration(); got != tt.want {
+				t.Errorf("Duration() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlertFingerprint(t *testing.T) {
+	labels := map[string]string{"alertname": "DiskFull", "instance": "node-1:9100"}
+	same := map[string]string{"instance": "node-1:9100", "alertname": "DiskFull"}
+	other := map[string]string{"alertname": "DiskFull", "instance": "node-2:9100"}
+
+	if got := (Alert{Labels: labels, Fingerprint: "abc"}).fingerprint(); got != "abc" {
+		t.Errorf("fingerprint() = %s, want abc", got)
+	}
+	fallback := Alert{Labels: labels}.fingerprint()
+	if fallback == "" || fallback != labelsFingerprint(labels) {
+		t.Errorf("fingerprint() without one = %q, want the labels fingerprint", fallback)
+	}
+	if got := (Alert{Labels: same}).fingerprint(); got != fallback {
+		t.Errorf("fingerprint() of the same labels = %s, want %s", got, fallback)
+	}
+	if got := (Alert{Labels: other}).fingerprint(); got == fallback {
+		t.Errorf("fingerprint() of other labels = %s, want another one", got)
+	}
+}
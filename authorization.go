@@ -0,0 +1,103 @@
+package main
+
+import (
+	"log/slog"
+	"strconv"
+	"strings"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Actions of the authorization section, each one includes the ones before it
+const (
+	actionRead    = "read"
+	actionAck     = "ack"
+	actionSilence = "silence"
+	actionAdmin   = "admin"
+)
+
+var actionLevels = map[string]int{
+	actionRead:    1,
+	actionAck:     2,
+	actionSilence: 3,
+	actionAdmin:   4,
+}
+
+// AuthRule lists who may perform an action: users by ID or username, or
+// everybody in the listed chats (IDs or aliases).
+type AuthRule struct {
+	Users []string `yaml:"users"`
+	Chats []string `yaml:"chats"`
+}
+
+func (r AuthRule) allows(user *tgbotapi.User, chatid int64) bool {
+	for _, u := range r.Users {
+		u = strings.TrimPrefix(strings.TrimSpace(u), "@")
+		if user == nil {
+			break
+		}
+		if strconv.FormatInt(user.ID, 10) == u || (user.UserName != "" && strings.EqualFold(user.UserName, u)) {
+			return true
+		}
+	}
+	for _, c := range r.Chats {
+		if id, _, err := resolveChat(c); err == nil && id == chatid {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize checks whether a user may perform an action in a chat. Without
+// an authorization section only reading is allowed, in the chats known from
+// the chats and routes sections, acknowledging and silencing need a rule.
+func authorize(action string, user *tgbotapi.User, chat *tgbotapi.Chat) bool {
+	cfg := current().cfg
+	var chatid int64
+	if chat != nil {
+		chatid = chat.ID
+	}
+
+	allowed := false
+	if len(cfg.Authorization) == 0 {
+		switch action {
+		case actionAdmin:
+			// Introducing the bot with the chat ID, as it always did
+			allowed = true
+		case actionRead:
+			allowed = knownChat(chatid)
+		}
+	} else {
+		for granted, rule := range cfg.Authorization {
+			if actionLevels[granted] >= actionLevels[action] && rule.allows(user, chatid) {
+				allowed = true
+				break
+			}
+		}
+	}
+
+	if !allowed {
+		attrs := []any{"action", action, "chatid", chatid, "user", userName(user)}
+		if user != nil {
+			attrs = append(attrs, "userid", user.ID)
+		}
+		slog.Warn("Unauthorized attempt", attrs...)
+	}
+	return allowed
+}
+
+// warnAuthorization logs that the buttons and commands changing alerts are
+// refused to everybody, when they are enabled without an authorization section.
+func warnAuthorization(c *Config) {
+	if len(c.Authorization) == 0 && (c.Alertmanager.URL != "" || c.Alertmanager.AckButton) {
+		slog.Warn("Silence and Ack buttons and commands are refused to everybody, add an authorization section to allow them")
+	}
+}
+
+// callbackAction returns the action needed to press a callback button.
+func callbackAction(data string) string {
+	if strings.HasPrefix(data, callbackAck+":") {
+		return actionAck
+	}
+	return actionSilence
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestAuthorize(t *testing.T) {
+	alice := &tgbotapi.User{ID: 1, UserName: "alice"}
+	bob := &tgbotapi.User{ID: 2, UserName: "bob"}
+	carol := &tgbotapi.User{ID: 3, UserName: "carol"}
+	oncall := &tgbotapi.Chat{ID: -100}
+	other := &tgbotapi.Chat{ID: -200}
+	chats := map[string]ChatConfig{"oncall": {ID: -100}}
+
+	open := &Config{Chats: chats}
+	rules := &Config{Chats: chats, Authorization: map[string]AuthRule{
+		actionRead:    {Chats: []string{"oncall"}},
+		actionSilence: {Users: []string{"@Alice"}},
+		actionAdmin:   {Users: []string{"2"}},
+	}}
+
+	tests := []struct {
+		name   string
+		cfg    *Config
+		action string
+		user   *tgbotapi.User
+		chat   *tgbotapi.Chat
+		want   bool
+	}{
+		{"no section, read in a known chat", open, actionRead, alice, oncall, true},
+		{"no section, read in another chat", open, actionRead, alice, other, false},
+		{"no section, ack", open, actionAck, alice, oncall, false},
+		{"no section, silence", open, actionSilence, alice, oncall, false},
+		{"no section, admin", open, actionAdmin, alice, other, true},
+		{"no chats, read anywhere", &Config{}, actionRead, alice, other, true},
+		{"no chats, silence", &Config{}, actionSilence, alice, other, false},
+		{"chat rule, read", rules, actionRead, carol, oncall, true},
+		{"chat rule, other chat", rules, actionRead, carol, other, false},
+		{"chat rule, ack needs more", rules, actionAck, carol, oncall, false},
+		{"user rule, case insensitive", rules, actionSilence, alice, other, true},
+		{"user rule includes ack", rules, actionAck, alice, other, true},
+		{"user rule excludes admin", rules, actionAdmin, alice, other, false},
+		{"admin by user ID", rules, actionAdmin, bob, other, true},
+		{"admin includes silence", rules, actionSilence, bob, other, true},
+		{"no user", rules, actionSilence, nil, other, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(tt.cfg)
+			if got := authorize(tt.action, tt.user, tt.chat); got != tt.want {
+				t.Errorf("authorize(%s) = %v, want %v", tt.action, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// CallbackRecord is what a callback button acts on. Telegram limits callback
+// data to 64 bytes, so buttons only carry the key of this record.
+type CallbackRecord struct {
+	GroupKey string            `json:"groupKey"`
+	Matchers map[string]string `json:"matchers"`
+	// Last time buttons were sent for the group
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+const (
+	callbackSilence = "silence"
+	callbackAck     = "ack"
+	// Alertmanager resends firing groups every repeat_interval, which
+	// refreshes their records, older records are of groups long gone
+	callbackMaxAge = 7 * 24 * time.Hour
+)
+
+// actionButtons returns the Silence/Ack buttons for a firing alert group.
+func actionButtons(alerts Alerts) []tgbotapi.InlineKeyboardButton {
+	cfg := current().cfg
+	if alerts.Status != "firing" {
+		return nil
+	}
+
+	matchers := callbackMatchers(alerts)
+	if len(matchers) == 0 {
+		return nil
+	}
+
+	token := labelsFingerprint(matchers)
+	var row []tgbotapi.InlineKeyboardButton
+
+	if cfg.Alertmanager.URL != "" {
+		for _, d := range cfg.Alertmanager.SilenceDurations {
+			data := fmt.Sprintf("%s:%s:%s", callbackSilence, shortDuration(d), token)
+			row = append(row, tgbotapi.NewInlineKeyboardButtonData("Silence "+shortDuration(d), data))
+		}
+	}
+	if cfg.Alertmanager.AckButton {
+		data := fmt.Sprintf("%s:%s", callbackAck, token)
+		row = append(row, tgbotapi.NewInlineKeyboardButtonData("Ack", data))
+	}
+	if len(row) == 0 {
+		return nil
+	}
+
+	err := store.Put(bucketCallbacks, token, CallbackRecord{
+		GroupKey:  alerts.GroupKey,
+		Matchers:  matchers,
+		CreatedAt: time.Now(),
+	})
+	if err != nil {
+		slog.Error("Can't store callback data, skipping action buttons", "error", err)
+		return nil
+	}
+
+	return row
+}
+
+// callbackMatchers returns the labels silences of a group match on, the
+// common labels identify every alert of the group.
+func callbackMatchers(alerts Alerts) map[string]string {
+	if len(alerts.CommonLabels) > 0 {
+		return alerts.CommonLabels
+	}
+	return alerts.GroupLabels
+}
+
+// forgetCallbacks removes the callback record of a group a webhook resolved,
+// its buttons are gone with the firing message. It takes the group of the
+// webhook: dedup and routing mark the part of a group they pass on resolved
+// while other alerts of the group still fire.
+func forgetCallbacks(alerts Alerts) {
+	matchers := callbackMatchers(alerts)
+	if alerts.Status != "resolved" || len(matchers) == 0 {
+		return
+	}
+	if err := store.Delete(bucketCallbacks, labelsFingerprint(matchers)); err != nil {
+		slog.Error("Can't remove callback data", "groupKey", alerts.GroupKey, "error", err)
+	}
+}
+
+// pruneCallbacks removes the callback records older than callbackMaxAge
+// every hour, those of groups that never resolved through the bot.
+func pruneCallbacks() {
+	for range time.Tick(time.Hour) {
+		if err := removeCallbacksBefore(time.Now().Add(-callbackMaxAge)); err != nil {
+			slog.Error("Can't prune callback data", "error", err)
+		}
+	}
+}
+
+func removeCallbacksBefore(t time.Time) error {
+	var expired []string
+	err := store.ForEach(bucketCallbacks, func(key string, value []byte) error {
+		var rec CallbackRecord
+		if err := json.Unmarshal(value, &rec); err != nil || rec.CreatedAt.Before(t) {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, key := range expired {
+		if err := store.Delete(bucketCallbacks, key); err != nil {
+			return err
+		}
+	}
+	if len(expired) > 0 {
+		slog.Debug("Pruned callback data", "count", len(expired))
+	}
+	return nil
+}
+
+// shortDuration formats 1h0m0s as 1h and 1h30m0s as 1h30m
+func shortDuration(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = s[:len(s)-2]
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = s[:len(s)-2]
+	}
+	return s
+}
+
+func userName(user *tgbotapi.User) string {
+	if user == nil {
+		return "unknown"
+	}
+	if user.UserName != "" {
+		return "@" + user.UserName
+	}
+	return strings.TrimSpace(user.FirstName + " " + user.LastName)
+}
+
+// formatTime prints a time in the configured time zone and format.
+func formatTime(t time.Time) string {
+	cfg := current().cfg
+	if loc, err := time.LoadLocation(cfg.TimeZone); err == nil && cfg.TimeZone != "" {
+		t = t.In(loc)
+	}
+	if cfg.TimeOutFormat != "" {
+		return t.Format(cfg.TimeOutFormat)
+	}
+	return t.Format("2006-01-02 15:04 MST")
+}
+
+func handleCallback(bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery) {
+	parts := strings.Split(query.Data, ":")
+	answer := ""
+
+	switch {
+	case len(parts) == 3 && parts[0] == callbackSilence:
+		answer = silenceCallback(bot, query, parts[1], parts[2])
+	case len(parts) == 2 && parts[0] == callbackAck:
+		answer = ackCallback(bot, query, parts[1])
+	default:
+		slog.Warn("Unknown callback data", "data", query.Data)
+		answer = "Unknown action"
+	}
+
+	if _, err := bot.Request(tgbotapi.NewCallback(query.ID, answer)); err != nil {
+		slog.Error("Can't answer callback query", "error", err)
+	}
+}
+
+func silenceCallback(bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery, duration string, token string) string {
+	var rec CallbackRecord
+	found, err := store.Get(bucketCallbacks, token, &rec)
+	if err != nil || !found {
+		slog.Error("Can't find alerts for callback", "token", token, "error", err)
+		return "Alert is not known anymore"
+	}
+
+	// Only the durations of the buttons, the callback data comes from the client
+	d, err := time.ParseDuration(duration)
+	if err != nil || !slices.Contains(current().cfg.Alertmanager.SilenceDurations, d) {
+		return "Invalid silence duration"
+	}
+
+	by := userName(query.From)
+	now := time.Now()
+	silence := Silence{
+		Matchers:  equalMatchers(rec.Matchers),
+		StartsAt:  now,
+		EndsAt:    now.Add(d),
+		CreatedBy: by,
+		Comment:   "Silenced from Telegram by " + by,
+	}
+	id, err := createSilence(silence)
+	if err != nil {
+		slog.Error("Can't create silence", "error", err)
+		return "Failed to create silence, checkout logs"
+	}
+	slog.Info("Silence created", "id", id, "by", by, "until", silence.EndsAt, "matchers", rec.Matchers)
+
+	if query.Message != nil {
+		err = store.Put(bucketSilences, id, SilenceRecord{
+			ID:        id,
+			ChatID:    query.Message.Chat.ID,
+			Matchers:  rec.Matchers,
+			CreatedBy: by,
+			StartsAt:  silence.StartsAt,
+			EndsAt:    silence.EndsAt,
+		})
+		if err != nil {
+			slog.Error("Can't record silence", "id", id, "error", err)
+		}
+		// Silenced alerts need no more actions
+		annotateMessage(bot, query.Message, fmt.Sprintf("🔕 Silenced by %s until %s", by, formatTime(silence.EndsAt)), func(string) bool {
+			return true
+		})
+	}
+
+	return "Silenced until " + formatTime(silence.EndsAt)
+}
+
+func ackCallback(bot *tgbotapi.BotAPI, query *tgbotapi.CallbackQuery, token string) string {
+	var rec CallbackRecord
+	if _, err := store.Get(bucketCallbacks, token, &rec); err != nil {
+		slog.Error("Can't read callback data", "token", token, "error", err)
+	}
+	if query.Message == nil {
+		return "Message is not available anymore"
+	}
+
+	by := userName(query.From)
+	ack := AckRecord{
+		ChatID:    query.Message.Chat.ID,
+		MessageID: query.Message.MessageID,
+		GroupKey:  rec.GroupKey,
+		UserName:  by,
+		At:        time.Now(),
+	}
+	if query.From != nil {
+		ack.UserID = query.From.ID
+	}
+	err := store.Put(bucketAcks, fmt.Sprintf("%d/%d", ack.ChatID, ack.MessageID), ack)
+	if err != nil {
+		slog.Error("Can't record acknowledgement", "error", err)
+	}
+	slog.Info("Alert acknowledged", "by", by, "chatid", ack.ChatID, "groupKey", rec.GroupKey)
+
+	annotateMessage(bot, query.Message, fmt.Sprintf("👀 Acknowledged by %s at %s", by, formatTime(ack.At)), func(data string) bool {
+		return strings.HasPrefix(data, callbackAck+":")
+	})
+
+	return "Acknowledged"
+}
+
+// annotateMessage appends a note to a message and removes the callback
+// buttons matched by drop. The original formatting is kept by reusing the
+// message entities, they stay valid because the note is appended at the end.
+func annotateMessage(bot *tgbotapi.BotAPI, message *tgbotapi.Message, note string, drop func(data string) bool) {
+	edit := tgbotapi.NewEditMessageText(message.Chat.ID, message.MessageID, message.Text+"\n\n"+note)
+	edit.Entities = message.Entities
+	edit.DisableWebPagePreview = true
+
+	if message.ReplyMarkup != nil {
+		var rows [][]tgbotapi.InlineKeyboardButton
+		for _, row := range message.ReplyMarkup.InlineKeyboard {
+			var kept []tgbotapi.InlineKeyboardButton
+			for _, btn := range row {
+				if btn.CallbackData != nil && drop(*btn.CallbackData) {
+					continue
+				}
+				kept = append(kept, btn)
+			}
+			if len(kept) > 0 {
+				rows = append(rows, kept)
+			}
+		}
+		if len(rows) > 0 {
+			keyboard := tgbotapi.NewInlineKeyboardMarkup(rows...)
+			edit.ReplyMarkup = &keyboard
+		}
+	}
+
+	waitToSend(message.Chat.ID)
+	_, err := bot.Send(edit)
+	countSend(message.Chat.ID, err)
+	if err != nil && !isNotModified(err) {
+		slog.Error("Can't update message", "chatid", message.Chat.ID, "messageid", message.MessageID, "error", err)
+	}
+}
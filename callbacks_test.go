@@ -0,0 +1,205 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestRemoveCallbacksBefore(t *testing.T) {
+	useConfig(&Config{})
+	now := time.Now()
+	store.Put(bucketCallbacks, "test-recent", CallbackRecord{GroupKey: "recent", CreatedAt: now.Add(-time.Hour)})
+	store.Put(bucketCallbacks, "test-old", CallbackRecord{GroupKey: "old", CreatedAt: now.Add(-8 * 24 * time.Hour)})
+	store.Put(bucketCallbacks, "test-undated", CallbackRecord{GroupKey: "undated"})
+
+	if err := removeCallbacksBefore(now.Add(-callbackMaxAge)); err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]bool{"test-recent": true, "test-old": false, "test-undated": false} {
+		if found, _ := store.Get(bucketCallbacks, key, &CallbackRecord{}); found != want {
+			t.Errorf("%s kept = %v, want %v", key, found, want)
+		}
+	}
+}
+
+func TestForgetCallbacks(t *testing.T) {
+	useConfig(&Config{})
+	labels := map[string]string{"alertname": "DiskFull", "instance": "db1"}
+	token := labelsFingerprint(labels)
+
+	tests := []struct {
+		status string
+		kept   bool
+	}{
+		{"firing", true},
+		{"resolved", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.status, func(t *testing.T) {
+			store.Put(bucketCallbacks, token, CallbackRecord{Matchers: labels, CreatedAt: time.Now()})
+			forgetCallbacks(Alerts{Status: tt.status, CommonLabels: labels})
+			if found, _ := store.Get(bucketCallbacks, token, &CallbackRecord{}); found != tt.kept {
+				t.Errorf("record kept = %v, want %v", found, tt.kept)
+			}
+		})
+	}
+}
+
+func TestWebhookKeepsCallbacksOfFiringGroup(t *testing.T) {
+	received := make(chan struct{}, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- struct{}{}
+	}))
+	defer server.Close()
+
+	cfg := useConfig(&Config{Chats: map[string]ChatConfig{
+		"callbacks": {Notifier: &NotifierConfig{Type: "webhook", URL: server.URL}},
+	}})
+	cfg.Dedup.Policy = dedupChanged
+	router := gin.New()
+	router.POST("/alert/:chatid", POST_Handling)
+
+	common := map[string]string{"alertname": "CallbackGroup"}
+	token := labelsFingerprint(common)
+	store.Put(bucketCallbacks, token, CallbackRecord{Matchers: common, CreatedAt: time.Now()})
+	alert := func(instance, status string) string {
+		return fmt.Sprintf(`{"status": %q, "labels": {"alertname": "CallbackGroup", "instance": %q}, "startsAt": "2024-01-01T00:00:00Z"}`, status, instance)
+	}
+	post := func(status string, alerts ...string) {
+		body := fmt.Sprintf(`{"status": %q, "commonLabels": {"alertname": "CallbackGroup"}, "alerts": [%s]}`, status, strings.Join(alerts, ","))
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/alert/callbacks", strings.NewReader(body)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("POST = %d %s", w.Code, w.Body)
+		}
+		select {
+		case <-received:
+		case <-time.After(5 * time.Second):
+			t.Fatal("webhook was not delivered")
+		}
+		for deadline := time.Now().Add(5 * time.Second); queue.Depth() > 0 && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	post("firing", alert("a", "firing"), alert("b", "firing"))
+	// Dedup passes on a resolved part of a group that still fires
+	post("firing", alert("a", "resolved"), alert("b", "firing"))
+	if found, _ := store.Get(bucketCallbacks, token, &CallbackRecord{}); !found {
+		t.Error("callback record of a firing group was removed")
+	}
+
+	post("resolved", alert("a", "resolved"), alert("b", "resolved"))
+	if found, _ := store.Get(bucketCallbacks, token, &CallbackRecord{}); found {
+		t.Error("callback record of a resolved group was kept")
+	}
+}
+
+func TestSilenceCallback(t *testing.T) {
+	var created []Silence
+	am := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.URL.Path != "/api/v2/silences" {
+			http.NotFound(w, r)
+			return
+		}
+		var s Silence
+		if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+			t.Errorf("silence body: %v", err)
+		}
+		created = append(created, s)
+		fmt.Fprintf(w, `{"silenceID": "silence-%d"}`, len(created))
+	}))
+	defer am.Close()
+
+	cfg := useConfig(&Config{})
+	cfg.Alertmanager.URL = am.URL
+	cfg.Alertmanager.SilenceDurations = []time.Duration{time.Hour}
+	bot, fake := newFakeTelegram(t)
+
+	matchers := map[string]string{"alertname": "SilenceMe", "instance": "db1"}
+	store.Put(bucketCallbacks, "test-silence", CallbackRecord{Matchers: matchers, CreatedAt: time.Now()})
+	silenceData := "silence:1h:test-silence"
+
+	tests := []struct {
+		name    string
+		data    string
+		answer  string
+		created bool
+	}{
+		{name: "button", data: silenceData, answer: "Silenced until", created: true},
+		{name: "duration without a button", data: "silence:720h:test-silence", answer: "Invalid silence duration"},
+		{name: "unknown group", data: "silence:1h:test-unknown", answer: "Alert is not known anymore"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			created = nil
+			fake.mu.Lock()
+			fake.calls = nil
+			fake.mu.Unlock()
+
+			keyboard := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(
+				tgbotapi.NewInlineKeyboardButtonData("Silence 1h", silenceData),
+				tgbotapi.NewInlineKeyboardButtonURL("Dashboard", "https://grafana"),
+			))
+			handleCallback(bot, &tgbotapi.CallbackQuery{
+				ID:   "query",
+				From: &tgbotapi.User{UserName: "alice"},
+				Data: tt.data,
+				Message: &tgbotapi.Message{
+					MessageID:   7,
+					Chat:        &tgbotapi.Chat{ID: -31},
+					Text:        "SilenceMe is firing",
+					ReplyMarkup: &keyboard,
+				},
+			})
+
+			fake.mu.Lock()
+			calls := fake.calls
+			fake.mu.Unlock()
+			last := calls[len(calls)-1]
+			if last.Method != "answerCallbackQuery" || !strings.Contains(last.Params.Get("text"), tt.answer) {
+				t.Errorf("answer = %s %q, want %q", last.Method, last.Params.Get("text"), tt.answer)
+			}
+			if (len(created) > 0) != tt.created {
+				t.Fatalf("silences created = %d, want created %v", len(created), tt.created)
+			}
+			if !tt.created {
+				if len(calls) != 1 {
+					t.Errorf("calls = %d, want only the answer", len(calls))
+				}
+				return
+			}
+
+			s := created[0]
+			if !reflect.DeepEqual(s.Matchers, equalMatchers(matchers)) || s.CreatedBy != "@alice" {
+				t.Errorf("silence = %+v, want the matchers of the group by @alice", s)
+			}
+			if d := s.EndsAt.Sub(s.StartsAt); d != time.Hour {
+				t.Errorf("silence lasts %v, want 1h", d)
+			}
+			var rec SilenceRecord
+			if found, _ := store.Get(bucketSilences, "silence-1", &rec); !found || rec.ChatID != -31 {
+				t.Errorf("silence record = %+v, %v, want one of chat -31", rec, found)
+			}
+
+			edit := calls[0]
+			if edit.Method != "editMessageText" || edit.Params.Get("message_id") != "7" ||
+				!strings.Contains(edit.Params.Get("text"), "🔕 Silenced by @alice") {
+				t.Errorf("edit = %s %v, want the message annotated", edit.Method, edit.Params)
+			}
+			// The silence buttons go, the links stay
+			if markup := edit.Params.Get("reply_markup"); strings.Contains(markup, silenceData) || !strings.Contains(markup, "Dashboard") {
+				t.Errorf("reply_markup = %s, want only the Dashboard button", markup)
+			}
+		})
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// ChatConfig is a named chat, so alert manager configs and routes can use
+// "oncall" instead of a raw chat ID.
+type ChatConfig struct {
+	ID    int64 `yaml:"id"`
+	Topic int64 `yaml:"topic"`
+	// Replaces the global webhook_auth for /alert/<alias>
+	WebhookAuth *WebhookAuth `yaml:"webhook_auth"`
+	// Sends to another chat system than Telegram, id and topic are not used
+	Notifier *NotifierConfig `yaml:"notifier"`
+}
+
+// ChatMigration records that Telegram upgraded a group to a supergroup.
+type ChatMigration struct {
+	From int64     `json:"from"`
+	To   int64     `json:"to"`
+	At   time.Time `json:"at"`
+}
+
+// migratedChatID follows the recorded group to supergroup migrations of a chat.
+func migratedChatID(chatid int64) int64 {
+	// A group migrates only once, the bound protects against a broken store
+	for i := 0; i < 5; i++ {
+		var migration ChatMigration
+		found, err := store.Get(bucketChats, strconv.FormatInt(chatid, 10), &migration)
+		if err != nil {
+			slog.Error("Can't read chat migration", "chatid", chatid, "error", err)
+			return chatid
+		}
+		if !found {
+			return chatid
+		}
+		chatid = migration.To
+	}
+	return chatid
+}
+
+// recordMigration persists a group to supergroup migration, aliases pointing
+// to the old chat are resolved to the new one from now on.
+func recordMigration(from int64, to int64) {
+	cfg := current().cfg
+	err := store.Put(bucketChats, strconv.FormatInt(from, 10), ChatMigration{
+		From: from,
+		To:   to,
+		At:   time.Now(),
+	})
+	if err != nil {
+		slog.Error("Can't record chat migration", "from", from, "to", to, "error", err)
+	}
+
+	slog.Warn("Chat was migrated to a supergroup", "from", from, "to", to)
+	for alias, chat := range cfg.Chats {
+		if chat.ID == from {
+			slog.Warn("Chat alias re-pointed, update the configuration", "alias", alias, "from", from, "to", to)
+		}
+	}
+}
+
+// warnMigratedChats logs the chat aliases and routes of c still pointing to
+// a group that was migrated to a supergroup, they work through the recorded
+// migration but are lost with the storage.
+func warnMigratedChats(c *Config) {
+	err := store.ForEach(bucketChats, func(key string, value []byte) error {
+		var migration ChatMigration
+		if err := json.Unmarshal(value, &migration); err != nil {
+			return nil
+		}
+		to := migratedChatID(migration.From)
+		for alias, chat := range c.Chats {
+			if chat.ID == migration.From {
+				slog.Warn("Chat alias points to a migrated group, update the configuration", "alias", alias, "from", migration.From, "to", to)
+			}
+		}
+		targets := func(chatid int64) bool { return chatid == migration.From }
+		for _, route := range routesTargeting(c.Routes, targets) {
+			slog.Warn("Route targets a migrated group, update the configuration", "matchers", route.Matchers, "from", migration.From, "to", to)
+		}
+		return nil
+	})
+	if err != nil {
+		slog.Error("Can't read chat migrations", "error", err)
+	}
+}
+
+// migrateToChatID returns the new chat ID when Telegram refused a message
+// because the group was migrated to a supergroup.
+func migrateToChatID(err error) int64 {
+	var tgErr *tgbotapi.Error
+	if errors.As(err, &tgErr) {
+		return tgErr.MigrateToChatID
+	}
+	return 0
+}
+
+// sendMessage sends a message within the rate limits, following a group to
+// supergroup migration.
+func sendMessage(bot *tgbotapi.BotAPI, msg tgbotapi.MessageConfig) (tgbotapi.Message, error) {
+	waitToSend(msg.ChatID)
+	sent, err := bot.Send(msg)
+	if to := migrateToChatID(err); to != 0 {
+		recordMigration(msg.ChatID, to)
+		msg.ChatID = to
+		waitToSend(msg.ChatID)
+		sent, err = bot.Send(msg)
+	}
+	countSend(msg.ChatID, err)
+	return sent, err
+}
+
+// resolveChat returns the chat ID and default topic for a number or an alias.
+func resolveChat(chat string) (int64, int64, error) {
+	cfg := current().cfg
+	if alias, ok := cfg.Chats[chat]; ok {
+		return migratedChatID(alias.ID), alias.Topic, nil
+	}
+	id, err := strconv.ParseInt(chat, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return migratedChatID(id), 0, nil
+}
+
+// chatNotifier returns the chat alias when it sends with a notifier instead
+// of Telegram.
+func chatNotifier(chat string) string {
+	cfg := current().cfg
+	if alias, ok := cfg.Chats[chat]; ok && alias.Notifier != nil {
+		return chat
+	}
+	return ""
+}
+
+// chatKey identifies a chat of any chat system, by its Telegram chat ID or
+// by the chat alias of its notifier.
+func chatKey(chatid int64, notifier string) string {
+	if notifier != "" {
+		return notifier
+	}
+	return strconv.FormatInt(chatid, 10)
+}
+
+// getChat gets the chat and topic from the relative path, the chat can be
+// an alias from the chats section of the config. It answers 400 when they
+// are not valid.
+func getChat(c *gin.Context) (int64, int64, bool) {
+	topicid, err := getID(c, "topicid")
+	if err != nil {
+		rejectWebhook(c, http.StatusBadRequest, "invalid_chat", err.Error(), nil)
+		return 0, 0, false
+	}
+
+	chatid, topic, err := resolveChat(c.Param("chatid"))
+	if err != nil {
+		message := fmt.Sprintf("chatid %q is neither a chat ID nor a chat alias", c.Param("chatid"))
+		rejectWebhook(c, http.StatusBadRequest, "invalid_chat", message, nil)
+		return 0, 0, false
+	}
+	if c.Param("topicid") == "" {
+		topicid = topic
+	}
+	return chatid, topicid, true
+}
@@ -0,0 +1,433 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Maximum number of alerts or silences listed in a reply
+const maxListed = 30
+
+type botCommand struct {
+	description string
+	action      string
+	handler     func(message *tgbotapi.Message) string
+}
+
+var commands map[string]botCommand
+
+func init() {
+	commands = map[string]botCommand{
+		"alerts":    {"List firing alerts", actionRead, commandAlerts},
+		"silences":  {"List active silences", actionRead, commandSilences},
+		"silence":   {"Silence alerts: /silence <matchers> <duration>", actionSilence, commandSilence},
+		"unsilence": {"Expire a silence: /unsilence <id>", actionSilence, commandUnsilence},
+		"status":    {"Show bot status", actionRead, commandStatus},
+	}
+}
+
+var startTime = time.Now()
+
+// deliveryStatus remembers the last failed delivery for /status
+var deliveryStatus struct {
+	sync.Mutex
+	lastError   string
+	lastErrorAt time.Time
+	lastChatID  int64
+}
+
+func recordDeliveryError(chatid int64, err error) {
+	deliveryStatus.Lock()
+	defer deliveryStatus.Unlock()
+	deliveryStatus.lastError = err.Error()
+	deliveryStatus.lastErrorAt = time.Now()
+	deliveryStatus.lastChatID = chatid
+}
+
+// registerCommands publishes the command list shown by Telegram clients.
+func registerCommands(bot *tgbotapi.BotAPI) {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	var list []tgbotapi.BotCommand
+	for _, name := range names {
+		list = append(list, tgbotapi.BotCommand{Command: name, Description: commands[name].description})
+	}
+	if _, err := bot.Request(tgbotapi.NewSetMyCommands(list...)); err != nil {
+		slog.Warn("Can't register bot commands", "error", err)
+	}
+}
+
+// knownChat reports whether commands are accepted in a chat: only chats the
+// bot delivers alerts to through aliases or routes, or any chat when none
+// are configured.
+func knownChat(chatid int64) bool {
+	cfg := current().cfg
+	if len(cfg.Chats) == 0 && len(cfg.Routes) == 0 {
+		return true
+	}
+	for _, chat := range cfg.Chats {
+		if migratedChatID(chat.ID) == chatid {
+			return true
+		}
+	}
+	return len(chatRoutes(chatid)) > 0
+}
+
+// chatRoutes returns the routes targeting a chat.
+func chatRoutes(chatid int64) []*Route {
+	cfg := current().cfg
+	return routesTargeting(cfg.Routes, func(id int64) bool {
+		return migratedChatID(id) == chatid
+	})
+}
+
+// routesTargeting returns the routes of the tree with a target chat ID match
+// accepts.
+func routesTargeting(routes []Route, match func(chatid int64) bool) []*Route {
+	var res []*Route
+	for i := range routes {
+		for _, t := range routes[i].Targets {
+			if t.notifier == "" && match(t.ChatID) {
+				res = append(res, &routes[i])
+				break
+			}
+		}
+		res = append(res, routesTargeting(routes[i].Routes, match)...)
+	}
+	return res
+}
+
+// handleCommand runs an authorized command and replies with its result.
+func handleCommand(bot *tgbotapi.BotAPI, message *tgbotapi.Message, cmd botCommand) {
+	slog.Info("Bot command", "command", message.Command(), "chatid", message.Chat.ID, "user", userName(message.From))
+	reply(bot, message, cmd.handler(message))
+}
+
+// reply answers a message with an HTML text.
+func reply(bot *tgbotapi.BotAPI, message *tgbotapi.Message, text string) {
+	cfg := current().cfg
+	for _, part := range SplitString(text, cfg.SplitMessageBytes) {
+		msg := tgbotapi.NewMessage(message.Chat.ID, SanitizeMsg(part))
+		msg.ParseMode = tgbotapi.ModeHTML
+		msg.ReplyToMessageID = message.MessageID
+		msg.DisableWebPagePreview = true
+		if cfg.DisableNotification {
+			msg.DisableNotification = true
+		}
+		if _, err := sendMessage(bot, msg); err != nil {
+			slog.Error("Error sending command reply", "chatid", message.Chat.ID, "error", err)
+		}
+	}
+}
+
+func formatLabels(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	parts := make([]string, 0, len(names))
+	for _, name := range names {
+		parts = append(parts, fmt.Sprintf("%s=<code>%s</code>", name, html.EscapeString(labels[name])))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// routedToChat reports whether the routes send an alert to a chat.
+func routedToChat(labels map[string]string, chatid int64) bool {
+	cfg := current().cfg
+	for _, t := range matchRoutes(cfg.Routes, labels, nil, "") {
+		if t.notifier == "" && migratedChatID(t.ChatID) == chatid {
+			return true
+		}
+	}
+	return false
+}
+
+func commandAlerts(message *tgbotapi.Message) string {
+	alerts, err := listAlerts()
+	if err != nil {
+		slog.Error("Can't list alerts", "error", err)
+		return "Can't list alerts, checkout logs"
+	}
+
+	// Only the alerts routed to this chat, when it has routes
+	if len(chatRoutes(message.Chat.ID)) > 0 {
+		filtered := alerts[:0]
+		for _, a := range alerts {
+			if routedToChat(a.Labels, message.Chat.ID) {
+				filtered = append(filtered, a)
+			}
+		}
+		alerts = filtered
+	}
+
+	if len(alerts) == 0 {
+		return "No firing alerts ✅"
+	}
+	sort.Slice(alerts, func(i, j int) bool {
+		return alerts[i].StartsAt.Before(alerts[j].StartsAt)
+	})
+
+	lines := []string{fmt.Sprintf("<b>Firing alerts: %d</b>", len(alerts))}
+	for i, a := range alerts {
+		if i == maxListed {
+			lines = append(lines, fmt.Sprintf("… and %d more", len(alerts)-maxListed))
+			break
+		}
+		name := html.EscapeString(a.Labels["alertname"])
+		if isValidURL(a.GeneratorURL) {
+			name = fmt.Sprintf("<a href=\"%s\">%s</a>", html.EscapeString(a.GeneratorURL), name)
+		}
+		labels := make(map[string]string, len(a.Labels))
+		for k, v := range a.Labels {
+			if k != "alertname" {
+				labels[k] = v
+			}
+		}
+		lines = append(lines, fmt.Sprintf("🔥 %s since %s\n%s", name, formatTime(a.StartsAt), formatLabels(labels)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func formatMatchers(matchers []Matcher) string {
+	parts := make([]string, 0, len(matchers))
+	for _, m := range matchers {
+		op := "="
+		switch {
+		case m.IsRegex && m.IsEqual:
+			op = "=~"
+		case m.IsRegex:
+			op = "!~"
+		case !m.IsEqual:
+			op = "!="
+		}
+		parts = append(parts, fmt.Sprintf("%s%s<code>%s</code>", m.Name, op, html.EscapeString(m.Value)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+func commandSilences(message *tgbotapi.Message) string {
+	silences, err := listSilences()
+	if err != nil {
+		slog.Error("Can't list silences", "error", err)
+		return "Can't list silences, checkout logs"
+	}
+
+	// Like /alerts, only the silences of this chat when it has routes
+	if len(chatRoutes(message.Chat.ID)) > 0 {
+		silences, err = chatSilences(silences, message.Chat.ID)
+		if err != nil {
+			slog.Error("Can't list silenced alerts", "error", err)
+			return "Can't list silences, checkout logs"
+		}
+	}
+	if len(silences) == 0 {
+		return "No active silences"
+	}
+	sort.Slice(silences, func(i, j int) bool {
+		return silences[i].EndsAt.Before(silences[j].EndsAt)
+	})
+
+	lines := []string{fmt.Sprintf("<b>Active silences: %d</b>", len(silences))}
+	for i, s := range silences {
+		if i == maxListed {
+			lines = append(lines, fmt.Sprintf("… and %d more", len(silences)-maxListed))
+			break
+		}
+		lines = append(lines, fmt.Sprintf("🔕 <code>%s</code> until %s by %s\n%s",
+			s.ID, formatTime(s.EndsAt), html.EscapeString(s.CreatedBy), formatMatchers(s.Matchers)))
+	}
+	return strings.Join(lines, "\n")
+}
+
+// chatSilences keeps the silences created from a chat, and the ones
+// silencing alerts routed to it.
+func chatSilences(silences []Silence, chatid int64) ([]Silence, error) {
+	alerts, err := listSilencedAlerts()
+	if err != nil {
+		return nil, err
+	}
+	routed := map[string]bool{}
+	for _, a := range alerts {
+		if routedToChat(a.Labels, chatid) {
+			for _, id := range a.Status.SilencedBy {
+				routed[id] = true
+			}
+		}
+	}
+
+	filtered := silences[:0]
+	for _, s := range silences {
+		var rec SilenceRecord
+		found, err := store.Get(bucketSilences, s.ID, &rec)
+		if err != nil {
+			slog.Error("Can't read silence record", "id", s.ID, "error", err)
+		}
+		if routed[s.ID] || (found && migratedChatID(rec.ChatID) == chatid) {
+			filtered = append(filtered, s)
+		}
+	}
+	return filtered, nil
+}
+
+// commandArgs splits the arguments of a command on spaces, except in double
+// quoted strings, so matcher values can have spaces. Quotes and escapes are
+// kept for parseMatcher.
+func commandArgs(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg, quoted, escaped := false, false, false
+	for _, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case quoted && r == '\\':
+			escaped = true
+		case r == '"':
+			quoted = !quoted
+		case !quoted && unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+			continue
+		}
+		arg.WriteRune(r)
+		inArg = true
+	}
+	if quoted {
+		return nil, errors.New("unterminated quoted string")
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// commandSilence creates a silence from matchers and a duration, like
+// /silence alertname="Disk full" instance=~"db.*" 2h
+func commandSilence(message *tgbotapi.Message) string {
+	args, err := commandArgs(message.CommandArguments())
+	if err != nil {
+		return html.EscapeString(err.Error())
+	}
+	if len(args) < 2 {
+		return "Usage: /silence &lt;matchers&gt; &lt;duration&gt;, e.g. /silence alertname=\"DiskFull\" 2h"
+	}
+
+	d, err := time.ParseDuration(args[len(args)-1])
+	if err != nil || d <= 0 {
+		return fmt.Sprintf("Invalid duration <code>%s</code>", html.EscapeString(args[len(args)-1]))
+	}
+
+	var matchers []Matcher
+	for _, arg := range args[:len(args)-1] {
+		m, err := parseMatcher(arg)
+		if err != nil {
+			return html.EscapeString(err.Error())
+		}
+		matchers = append(matchers, Matcher{
+			Name:    m.name,
+			Value:   m.value,
+			IsRegex: m.op == "=~" || m.op == "!~",
+			IsEqual: m.op == "=" || m.op == "=~",
+		})
+	}
+
+	by := userName(message.From)
+	silence := Silence{
+		Matchers:  matchers,
+		StartsAt:  time.Now(),
+		EndsAt:    time.Now().Add(d),
+		CreatedBy: by,
+		Comment:   "Silenced from Telegram by " + by,
+	}
+	id, err := createSilence(silence)
+	if err != nil {
+		slog.Error("Can't create silence", "error", err)
+		return "Failed to create silence, checkout logs"
+	}
+	slog.Info("Silence created", "id", id, "by", by, "until", silence.EndsAt)
+
+	labels := make(map[string]string, len(matchers))
+	for _, m := range matchers {
+		labels[m.Name] = m.Value
+	}
+	err = store.Put(bucketSilences, id, SilenceRecord{
+		ID:        id,
+		ChatID:    message.Chat.ID,
+		Matchers:  labels,
+		CreatedBy: by,
+		StartsAt:  silence.StartsAt,
+		EndsAt:    silence.EndsAt,
+	})
+	if err != nil {
+		slog.Error("Can't record silence", "id", id, "error", err)
+	}
+
+	return fmt.Sprintf("🔕 Silence <code>%s</code> created until %s", id, formatTime(silence.EndsAt))
+}
+
+func commandUnsilence(message *tgbotapi.Message) string {
+	id := strings.TrimSpace(message.CommandArguments())
+	if id == "" {
+		return "Usage: /unsilence &lt;id&gt;"
+	}
+
+	// Like /silences, a chat with routes only manages its own silences
+	if len(chatRoutes(message.Chat.ID)) > 0 {
+		own, err := chatSilences([]Silence{{ID: id}}, message.Chat.ID)
+		if err != nil {
+			slog.Error("Can't list silenced alerts", "error", err)
+			return "Failed to check the silence, checkout logs"
+		}
+		if len(own) == 0 {
+			return fmt.Sprintf("Silence <code>%s</code> is not one of this chat's, see /silences", html.EscapeString(id))
+		}
+	}
+
+	if err := deleteSilence(id); err != nil {
+		slog.Error("Can't expire silence", "id", id, "error", err)
+		return "Failed to expire silence, checkout logs"
+	}
+	if err := store.Delete(bucketSilences, id); err != nil {
+		slog.Error("Can't forget silence", "id", id, "error", err)
+	}
+	slog.Info("Silence expired", "id", id, "by", userName(message.From))
+
+	return fmt.Sprintf("🔔 Silence <code>%s</code> expired", html.EscapeString(id))
+}
+
+func commandStatus(message *tgbotapi.Message) string {
+	lines := []string{
+		fmt.Sprintf("<b>%s</b> up for %s", html.EscapeString(current().bot.Self.UserName), time.Since(startTime).Round(time.Second)),
+		fmt.Sprintf("Queue: %d messages waiting, %d dropped", queue.Depth(), queue.Dropped()),
+	}
+
+	deliveryStatus.Lock()
+	if deliveryStatus.lastError == "" {
+		lines = append(lines, "Last delivery error: none")
+	} else {
+		lines = append(lines, fmt.Sprintf("Last delivery error at %s in chat %d: <code>%s</code>",
+			formatTime(deliveryStatus.lastErrorAt), deliveryStatus.lastChatID, html.EscapeString(deliveryStatus.lastError)))
+	}
+	deliveryStatus.Unlock()
+
+	return strings.Join(lines, "\n")
+}
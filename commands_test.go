@@ -0,0 +1,143 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestCommandArgs(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{in: "", want: nil},
+		{in: `alertname="DiskFull" 2h`, want: []string{`alertname="DiskFull"`, "2h"}},
+		{in: `alertname="Disk full"   instance=~"db.*"  2h`, want: []string{`alertname="Disk full"`, `instance=~"db.*"`, "2h"}},
+		{in: `summary="say \"hi\" now" 1h`, want: []string{`summary="say \"hi\" now"`, "1h"}},
+		{in: "env=prod\t30m", want: []string{"env=prod", "30m"}},
+		{in: `alertname="Disk full 2h`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := commandArgs(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("commandArgs() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("commandArgs() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCommandArgsParseAsMatchers(t *testing.T) {
+	args, err := commandArgs(`alertname="Disk full" 2h`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, err := parseMatcher(args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.name != "alertname" || m.value != "Disk full" {
+		t.Errorf("parseMatcher(%q) = %s, want alertname=\"Disk full\"", args[0], m)
+	}
+}
+
+func TestChatSilences(t *testing.T) {
+	am := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/alerts" || r.URL.Query().Get("silenced") != "true" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(`[
+			{"labels": {"alertname": "A", "team": "db"}, "status": {"state": "suppressed", "silencedBy": ["s1"]}},
+			{"labels": {"alertname": "B", "team": "web"}, "status": {"state": "suppressed", "silencedBy": ["s2"]}}
+		]`))
+	}))
+	defer am.Close()
+
+	cfg := useConfig(&Config{Routes: []Route{
+		{Matchers: []string{`team="db"`}, Targets: []RouteTarget{{ChatID: 10}}},
+		{Matchers: []string{`team="web"`}, Targets: []RouteTarget{{ChatID: 20}}},
+	}})
+	cfg.Alertmanager.URL = am.URL
+	if err := prepareRoutes(cfg.Routes, cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	store.Put(bucketSilences, "s3", SilenceRecord{ID: "s3", ChatID: 10})
+
+	silences := []Silence{{ID: "s1"}, {ID: "s2"}, {ID: "s3"}, {ID: "s4"}}
+	got, err := chatSilences(silences, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, s := range got {
+		ids = append(ids, s.ID)
+	}
+	if want := []string{"s1", "s3"}; !reflect.DeepEqual(ids, want) {
+		t.Errorf("chatSilences() = %v, want %v", ids, want)
+	}
+}
+
+func TestCommandUnsilence(t *testing.T) {
+	var expired []string
+	am := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/api/v2/alerts":
+			w.Write([]byte(`[{"labels": {"alertname": "A", "team": "unsilence-db"}, "status": {"state": "suppressed", "silencedBy": ["routed"]}}]`))
+		case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/api/v2/silence/"):
+			expired = append(expired, strings.TrimPrefix(r.URL.Path, "/api/v2/silence/"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer am.Close()
+
+	cfg := useConfig(&Config{Routes: []Route{
+		{Matchers: []string{`team="unsilence-db"`}, Targets: []RouteTarget{{ChatID: 41}}},
+	}})
+	cfg.Alertmanager.URL = am.URL
+	if err := prepareRoutes(cfg.Routes, cfg, nil); err != nil {
+		t.Fatal(err)
+	}
+	store.Put(bucketSilences, "created-here", SilenceRecord{ID: "created-here", ChatID: 41})
+	store.Put(bucketSilences, "other-team", SilenceRecord{ID: "other-team", ChatID: 42})
+
+	tests := []struct {
+		id      string
+		expired bool
+	}{
+		{id: "created-here", expired: true},
+		{id: "routed", expired: true},
+		{id: "other-team"},
+		{id: "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.id, func(t *testing.T) {
+			expired = nil
+			text := "/unsilence " + tt.id
+			reply := commandUnsilence(&tgbotapi.Message{
+				Text:     text,
+				Chat:     &tgbotapi.Chat{ID: 41},
+				Entities: []tgbotapi.MessageEntity{{Type: "bot_command", Offset: 0, Length: len("/unsilence")}},
+			})
+			if got := len(expired) > 0; got != tt.expired {
+				t.Errorf("/unsilence %s expired = %v (%s), want %v", tt.id, got, reply, tt.expired)
+			}
+			if !tt.expired && !strings.Contains(reply, "not one of this chat's") {
+				t.Errorf("/unsilence %s = %q, want a refusal", tt.id, reply)
+			}
+		})
+	}
+	if found, _ := store.Get(bucketSilences, "other-team", &SilenceRecord{}); !found {
+		t.Error("silence record of another chat was removed")
+	}
+}
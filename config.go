@@ -0,0 +1,347 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// loadConfig reads the configuration file, the token file and all the
+// templates. The running configuration is not touched, so a reload can
+// keep it when anything is invalid. The error lists all the problems found,
+// a missing token is one unless needToken is false, for the subcommands
+// that don't talk to Telegram.
+func loadConfig(needToken bool) (*Config, *template.Template, map[string]*template.Template, error) {
+	c := &Config{}
+
+	content, err := os.ReadFile(*config_path)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("problem reading configuration file: %w", err)
+	}
+	problems, err := decodeConfig(content, c)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("error parsing configuration file: %w", err)
+	}
+
+	if *template_path != "" {
+		c.TemplatePath = *template_path
+	}
+
+	if *token_path != "" {
+		content, err := os.ReadFile(*token_path)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("problem reading token file: %w", err))
+		}
+		c.TelegramToken = strings.TrimSpace(string(content))
+	}
+
+	setDefaults(c)
+	problems = append(problems, validateConfig(c)...)
+	if needToken && c.TelegramToken == "" {
+		problems = append(problems, errors.New("telegram_token is not set, set it in the config file, with telegram_token_file, "+envPrefix+"TELEGRAM_TOKEN or -token-from"))
+	}
+
+	var tmpl *template.Template
+	if c.TemplatePath != "" {
+		tmpl, err = parseTemplate(c.TemplatePath)
+		if err != nil {
+			problems = append(problems, fmt.Errorf("problem parsing template file: %w", err))
+		}
+	}
+
+	templates, err := loadTemplates(c)
+	if err != nil {
+		problems = append(problems, err)
+	}
+	if err := prepareRoutes(c.Routes, c, templates); err != nil {
+		problems = append(problems, err)
+	}
+
+	if len(problems) > 0 {
+		return nil, nil, nil, errors.Join(problems...)
+	}
+	return c, tmpl, templates, nil
+}
+
+// decodeConfig decodes the configuration file after applying the
+// environment to it, keys that are not settings are problems rather than
+// silently ignored. The error is a syntax error, nothing can be checked
+// after it.
+func decodeConfig(content []byte, c *Config) ([]error, error) {
+	var doc yaml.Node
+	if err := yaml.Unmarshal(content, &doc); err != nil {
+		return nil, err
+	}
+	if len(doc.Content) == 0 || doc.Content[0].Tag == "!!null" {
+		// An empty file, the settings can all come from the environment
+		doc = yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	}
+	if doc.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: the configuration must be a mapping of settings", doc.Content[0].Line)
+	}
+
+	problems := resolveConfig(&doc)
+	problems = append(problems, unknownSettings(doc.Content[0], reflect.TypeOf(*c))...)
+
+	if err := doc.Decode(c); err != nil {
+		var typeErr *yaml.TypeError
+		if !errors.As(err, &typeErr) {
+			return nil, err
+		}
+		for _, e := range typeErr.Errors {
+			problems = append(problems, errors.New(e))
+		}
+	}
+	return problems, nil
+}
+
+// validateConfig checks the settings of c, after the defaults are set.
+func validateConfig(c *Config) []error {
+	var problems []error
+	problem := func(format string, args ...any) {
+		problems = append(problems, fmt.Errorf(format, args...))
+	}
+
+	switch strings.ToUpper(c.LogLevel) {
+	case "DEBUG", "INFO", "WARN", "WARNING", "ERROR":
+	default:
+		problem("log_level %q is not one of DEBUG, INFO, WARN or ERROR", c.LogLevel)
+	}
+
+	if c.TimeZone != "" {
+		if _, err := time.LoadLocation(c.TimeZone); err != nil {
+			problem("time_zone: %v", err)
+		}
+	} else if c.TemplatePath != "" || len(c.Templates) > 0 {
+		problem("time_zone is required when templates are used")
+	}
+
+	if c.SplitMessageBytes < 0 || c.SplitMessageBytes > 4096 {
+		problem("split_msg_byte must be between 1 and 4096, the Telegram message limit")
+	}
+	if c.EditMaxAge < 0 {
+		problem("edit_max_age must be positive")
+	}
+	switch c.Dedup.Policy {
+	case dedupOff, dedupChanged:
+	default:
+		problem("unknown dedup.policy %q, use off or changed", c.Dedup.Policy)
+	}
+	if c.Dedup.ReminderInterval < 0 {
+		problem("dedup.reminder_interval must be positive")
+	} else if c.Dedup.ReminderInterval > 0 && c.Dedup.Policy != dedupChanged {
+		problem("dedup.reminder_interval needs dedup.policy changed")
+	}
+	if c.MaxBodyBytes < 0 {
+		problem("max_body_bytes must be positive")
+	}
+
+	for alias, chat := range c.Chats {
+		if chat.Notifier != nil {
+			for _, p := range validateNotifier(chat.Notifier) {
+				problem("chat alias %q: notifier %s", alias, p)
+			}
+		} else if chat.ID == 0 {
+			problem("chat alias %q has no id", alias)
+		}
+		if _, err := strconv.ParseInt(alias, 10, 64); err == nil {
+			problem("chat alias %q is a number, it would hide the chat with this ID", alias)
+		}
+	}
+
+	if (c.DefaultButtonName == "") != (c.DefaultButtonURL == "") {
+		problem("default_button_name and default_button_url must be set together")
+	} else if c.DefaultButtonURL != "" && !isValidURL(c.DefaultButtonURL) {
+		problem("default_button_url %q is not an http or https URL", c.DefaultButtonURL)
+	}
+	if c.Buttons.MaxButtonsPerRow < 0 || c.Buttons.MaxButtonsPerRow > 8 {
+		problem("buttons.max_buttons_per_row must be between 1 and 8")
+	}
+	if c.Buttons.MaxTotalButtons < 0 {
+		problem("buttons.max_total_buttons must be positive")
+	}
+	for i, btn := range c.Buttons.AlertButtons {
+		if btn.Key == "" {
+			problem("buttons.alert_buttons[%d] has no key", i)
+		}
+		for _, field := range buttonFieldRE.FindAllStringSubmatch(btn.TextTemplate, -1) {
+			if !buttonFields[field[1]] {
+				problem("buttons.alert_buttons[%d].text_template: unknown field %s, use .Index, .Value or .AlertName", i, field[1])
+			}
+		}
+	}
+
+	if c.Alertmanager.URL != "" && !isValidURL(c.Alertmanager.URL) {
+		problem("alertmanager.url %q is not an http or https URL", c.Alertmanager.URL)
+	}
+	if c.Alertmanager.BearerToken != "" && c.Alertmanager.Username != "" {
+		problem("alertmanager.bearer_token and alertmanager.username can't be used together")
+	}
+	for _, d := range c.Alertmanager.SilenceDurations {
+		if d <= 0 {
+			problem("alertmanager.silence_durations must be positive")
+		}
+	}
+
+	for _, auth := range webhookAuths(c) {
+		if (auth.Username == "") != (auth.Password == "") {
+			problem("webhook_auth.username and webhook_auth.password must be set together")
+		}
+	}
+
+	if c.TLS.enabled() {
+		if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+			problem("tls.cert_file and tls.key_file must be set together")
+		} else if _, err := (&certReloader{files: c.TLS}).load(); err != nil {
+			problem("tls: %v", err)
+		}
+	} else if c.TLS.ClientCAFile != "" {
+		problem("tls.client_ca_file needs tls.cert_file and tls.key_file")
+	}
+	if c.TLS.HealthcheckCertFile != "" || c.TLS.HealthcheckKeyFile != "" {
+		if c.TLS.ClientCAFile == "" {
+			problem("tls.healthcheck_cert_file and tls.healthcheck_key_file need tls.client_ca_file")
+		} else if c.TLS.HealthcheckCertFile == "" || c.TLS.HealthcheckKeyFile == "" {
+			problem("tls.healthcheck_cert_file and tls.healthcheck_key_file must be set together")
+		} else if _, err := tls.LoadX509KeyPair(c.TLS.HealthcheckCertFile, c.TLS.HealthcheckKeyFile); err != nil {
+			problem("tls: loading healthcheck certificate: %v", err)
+		}
+	}
+	if _, err := socketMode(c.ListenMode); err != nil {
+		problem("%v", err)
+	}
+
+	for action := range c.Authorization {
+		if _, ok := actionLevels[action]; !ok {
+			problem("unknown authorization action %q, use read, ack, silence or admin", action)
+		}
+	}
+
+	switch strings.ToLower(c.Storage.Backend) {
+	case "bolt", "bbolt", "memory":
+	default:
+		problem("unknown storage.backend %q, use bolt or memory", c.Storage.Backend)
+	}
+
+	if c.Queue.MaxAge < 0 || c.Queue.MinBackoff < 0 || c.Queue.MaxBackoff < 0 || c.Queue.MaxSize < 0 {
+		problem("queue settings must be positive")
+	} else if c.Queue.MinBackoff > c.Queue.MaxBackoff {
+		problem("queue.min_backoff is longer than queue.max_backoff")
+	}
+	if c.RateLimit.Global < 0 || c.RateLimit.PerChat < 0 || c.RateLimit.PerChatBurst < 0 {
+		problem("rate_limit settings must be positive")
+	}
+
+	return problems
+}
+
+// webhookAuths returns the global webhook_auth and the ones of the chat aliases.
+func webhookAuths(c *Config) []*WebhookAuth {
+	auths := []*WebhookAuth{&c.WebhookAuth}
+	for _, chat := range c.Chats {
+		if chat.WebhookAuth != nil {
+			auths = append(auths, chat.WebhookAuth)
+		}
+	}
+	return auths
+}
+
+// Fields text_template of alert buttons can use
+var (
+	buttonFieldRE = regexp.MustCompile(`{{\s*\.(\w+)\s*}}`)
+	buttonFields  = map[string]bool{"Index": true, "Value": true, "AlertName": true}
+)
+
+// setDefaults fills the settings left empty in the configuration file.
+func setDefaults(c *Config) {
+	if c.LogLevel == "" {
+		c.LogLevel = "INFO"
+	}
+
+	if c.Buttons.MaxButtonsPerRow == 0 {
+		c.Buttons.MaxButtonsPerRow = 3
+	}
+	if c.Buttons.MaxTotalButtons == 0 {
+		c.Buttons.MaxTotalButtons = 10
+	}
+	if c.Alertmanager.URL != "" && len(c.Alertmanager.SilenceDurations) == 0 {
+		c.Alertmanager.SilenceDurations = []time.Duration{time.Hour, 4 * time.Hour}
+	}
+
+	if c.SplitMessageBytes == 0 {
+		c.SplitMessageBytes = 4000
+	}
+
+	if c.EditMaxAge == 0 {
+		c.EditMaxAge = 48 * time.Hour
+	}
+
+	if c.Dedup.Policy == "" {
+		c.Dedup.Policy = dedupOff
+	}
+
+	if c.MaxBodyBytes == 0 {
+		c.MaxBodyBytes = 4 << 20
+	}
+
+	if c.Storage.Backend == "" {
+		c.Storage.Backend = "bolt"
+	}
+	if c.Storage.Path == "" {
+		c.Storage.Path = "prometheus_bot.db"
+	}
+
+	if c.Queue.MaxAge == 0 {
+		c.Queue.MaxAge = time.Hour
+	}
+	if c.Queue.MinBackoff == 0 {
+		c.Queue.MinBackoff = time.Second
+	}
+	if c.Queue.MaxBackoff == 0 {
+		c.Queue.MaxBackoff = 5 * time.Minute
+	}
+	if c.Queue.MaxSize == 0 {
+		c.Queue.MaxSize = 10000
+	}
+
+	for _, auth := range webhookAuths(c) {
+		if auth.HMACSecret != "" && auth.HMACHeader == "" {
+			auth.HMACHeader = "X-Signature"
+		}
+	}
+
+	if c.RateLimit.Global == 0 {
+		c.RateLimit.Global = 30
+	}
+	if c.RateLimit.PerChat == 0 {
+		c.RateLimit.PerChat = 20
+	}
+	if c.RateLimit.PerChatBurst == 0 {
+		c.RateLimit.PerChatBurst = 5
+	}
+}
+
+// runCheckConfig validates the configuration given by the -c, -t and
+// -token-from flags like the bot does at startup. It returns the exit code.
+func runCheckConfig(args []string) int {
+	if err := flag.CommandLine.Parse(args); err != nil {
+		return 2
+	}
+
+	if _, _, _, err := loadConfig(true); err != nil {
+		fmt.Fprintf(os.Stderr, "%s is not valid:\n%v\n", *config_path, err)
+		return 1
+	}
+	fmt.Printf("%s is valid\n", *config_path)
+	return 0
+}
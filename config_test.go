@@ -0,0 +1,111 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// useConfigFile makes content the config file, without -token-from, until
+// the end of the test.
+func useConfigFile(t *testing.T, content string) {
+	t.Helper()
+	prevConfig, prevToken := *config_path, *token_path
+	t.Cleanup(func() { *config_path, *token_path = prevConfig, prevToken })
+	*config_path = writeFile(t, t.TempDir(), "config.yaml", content)
+	*token_path = ""
+}
+
+// loadTestConfig loads content as the config file, with the -token-from
+// file when token is set.
+func loadTestConfig(t *testing.T, content string, token string) error {
+	t.Helper()
+	useConfigFile(t, content)
+	if token != "" {
+		*token_path = writeFile(t, t.TempDir(), "token", token+"\n")
+	}
+	_, _, _, err := loadConfig(true)
+	return err
+}
+
+func TestLoadConfigToken(t *testing.T) {
+	secret := writeFile(t, t.TempDir(), "secret", "from-file\n")
+
+	tests := []struct {
+		name    string
+		content string
+		env     string
+		flag    string
+		wantErr bool
+	}{
+		{name: "in the config", content: `telegram_token: "123:abc"`},
+		{name: "secret file", content: "telegram_token_file: " + secret},
+		{name: "environment", content: "log_level: INFO", env: "123:abc"},
+		{name: "token-from flag", content: "log_level: INFO", flag: "123:abc"},
+		{name: "missing", content: "log_level: INFO", wantErr: true},
+		{name: "empty", content: `telegram_token: ""`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv(envPrefix+"TELEGRAM_TOKEN", tt.env)
+			}
+			err := loadTestConfig(t, tt.content, tt.flag)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("loadConfig() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil && !strings.Contains(err.Error(), "telegram_token is not set") {
+				t.Errorf("loadConfig() error = %v, want the missing token", err)
+			}
+		})
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	tests := []struct {
+		name    string
+		content string
+		problem string
+	}{
+		{name: "minimal", content: `telegram_token: "x"`},
+		{name: "unknown setting", content: "telegram_token: x\nsplit_chart: '|'\nsplit_msg_bytes: 10", problem: "split_msg_bytes"},
+		{name: "log level", content: "telegram_token: x\nlog_level: LOUD", problem: "log_level"},
+		{name: "time zone", content: "telegram_token: x\ntime_zone: Mars/Olympus", problem: "time_zone"},
+		{name: "split too large", content: "telegram_token: x\nsplit_msg_byte: 5000", problem: "split_msg_byte"},
+		{name: "numeric alias", content: "telegram_token: x\nchats:\n  '123': {id: 1}", problem: "is a number"},
+		{name: "alias without id", content: "telegram_token: x\nchats:\n  oncall: {topic: 2}", problem: "has no id"},
+		{name: "reminder without dedup", content: "telegram_token: x\ndedup: {reminder_interval: 1h}", problem: "needs dedup.policy"},
+		{name: "storage backend", content: "telegram_token: x\nstorage: {backend: redis}", problem: "storage.backend"},
+		{name: "backoff order", content: "telegram_token: x\nqueue: {min_backoff: 1m, max_backoff: 1s}", problem: "min_backoff"},
+		{name: "authorization action", content: "telegram_token: x\nauthorization: {write: {users: [alice]}}", problem: "authorization action"},
+		{name: "webhook auth half set", content: "telegram_token: x\nwebhook_auth: {username: am}", problem: "webhook_auth.username"},
+		{name: "alertmanager url", content: "telegram_token: x\nalertmanager: {url: 'ftp://am'}", problem: "alertmanager.url"},
+		{name: "listen mode", content: "telegram_token: x\nlisten_mode: rw-rw----", problem: "listen_mode"},
+		{name: "healthcheck cert without mtls", content: "telegram_token: x\ntls: {healthcheck_cert_file: a.crt, healthcheck_key_file: a.key}", problem: "need tls.client_ca_file"},
+		{name: "unknown route alias", content: "telegram_token: x\nroutes:\n  - targets: [{chat: nobody}]", problem: "unknown chat alias"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := loadTestConfig(t, tt.content, "")
+			switch {
+			case tt.problem == "" && err != nil:
+				t.Errorf("loadConfig() = %v, want no problem", err)
+			case tt.problem != "" && (err == nil || !strings.Contains(err.Error(), tt.problem)):
+				t.Errorf("loadConfig() = %v, want a problem about %s", err, tt.problem)
+			}
+		})
+	}
+}
+
+func TestSetDefaults(t *testing.T) {
+	c := &Config{}
+	setDefaults(c)
+	if c.Storage.Backend != "bolt" || c.Storage.Path != "prometheus_bot.db" {
+		t.Errorf("storage = %+v, want bolt in the working directory", c.Storage)
+	}
+	if c.Queue.MinBackoff > c.Queue.MaxBackoff || c.Queue.MaxSize == 0 {
+		t.Errorf("queue = %+v, want usable defaults", c.Queue)
+	}
+	if problems := validateConfig(c); len(problems) > 0 {
+		t.Errorf("defaults are not valid: %v", problems)
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+// Policies of the dedup section
+const (
+	dedupOff     = "off"
+	dedupChanged = "changed"
+)
+
+// changedAlerts returns the alerts of a group to post in a chat. With the
+// changed policy these are the new firing alerts, the newly resolved ones
+// and the firing ones due for a reminder; false means nothing changed.
+func changedAlerts(chatid int64, topicid int64, notifier string, alerts Alerts) (Alerts, bool) {
+	cfg := current().cfg
+	if cfg.Dedup.Policy != dedupChanged {
+		return alerts, true
+	}
+
+	now := time.Now()
+	var changed []Alert
+	for _, alert := range alerts.Alerts {
+		var rec AlertRecord
+		found, err := store.Get(bucketAlerts, alertKey(chatKey(chatid, notifier), topicid, alert.fingerprint()), &rec)
+		if err != nil {
+			slog.Error("Can't read alert state, posting it", "fingerprint", alert.fingerprint(), "error", err)
+			changed = append(changed, alert)
+			continue
+		}
+
+		switch {
+		case alert.Status == "resolved":
+			// Resolved alerts that were never posted, or already posted resolved, are forgotten
+			if found {
+				changed = append(changed, alert)
+			}
+		case !found || !rec.StartsAt.Equal(alert.StartsAt):
+			changed = append(changed, alert)
+		case cfg.Dedup.ReminderInterval > 0 && now.Sub(rec.LastSentAt) >= cfg.Dedup.ReminderInterval:
+			changed = append(changed, alert)
+		}
+	}
+
+	alertsDeduplicated.Add(float64(len(alerts.Alerts) - len(changed)))
+	if len(changed) == 0 {
+		slog.Debug("No alert changed, nothing to post", "chat", chatKey(chatid, notifier), "groupKey", alerts.GroupKey)
+		return alerts, false
+	}
+	if cfg.EditMessages && notifier == "" {
+		// The message of the group is edited, it keeps showing all the alerts
+		return alerts, true
+	}
+
+	filtered := alerts
+	filtered.Alerts = changed
+	filtered.Status = "resolved"
+	if len(filtered.Firing()) > 0 {
+		filtered.Status = "firing"
+	}
+	return filtered, true
+}
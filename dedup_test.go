@@ -0,0 +1,104 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestChangedAlerts(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	firing := func(name string) Alert {
+		return Alert{Status: "firing", Labels: map[string]string{"alertname": name}, StartsAt: start}
+	}
+	resolved := func(name string) Alert {
+		a := firing(name)
+		a.Status = "resolved"
+		return a
+	}
+	restarted := firing("Disk")
+	restarted.StartsAt = start.Add(time.Hour)
+
+	tests := []struct {
+		name     string
+		policy   string
+		reminder time.Duration
+		edit     bool
+		notifier string
+		// Alerts already posted in the chat, and how long ago
+		posted  []Alert
+		sentAgo time.Duration
+		alerts  []Alert
+		want    []string
+		status  string
+		changed bool
+	}{
+		{name: "policy off", posted: []Alert{firing("Disk")}, alerts: []Alert{firing("Disk")}, want: []string{"Disk"}, status: "firing", changed: true},
+		{name: "new alert", policy: dedupChanged, alerts: []Alert{firing("Disk")}, want: []string{"Disk"}, status: "firing", changed: true},
+		{name: "already posted", policy: dedupChanged, posted: []Alert{firing("Disk")}, alerts: []Alert{firing("Disk")}, want: []string{"Disk"}, status: "firing", changed: false},
+		{name: "fired again", policy: dedupChanged, posted: []Alert{firing("Disk")}, alerts: []Alert{restarted}, want: []string{"Disk"}, status: "firing", changed: true},
+		{
+			name: "reminder due", policy: dedupChanged, reminder: time.Hour,
+			posted: []Alert{firing("Disk")}, sentAgo: 2 * time.Hour,
+			alerts: []Alert{firing("Disk")}, want: []string{"Disk"}, status: "firing", changed: true,
+		},
+		{
+			name: "reminder not due", policy: dedupChanged, reminder: time.Hour,
+			posted: []Alert{firing("Disk")}, sentAgo: time.Minute,
+			alerts: []Alert{firing("Disk")}, want: []string{"Disk"}, status: "firing", changed: false,
+		},
+		{name: "resolved", policy: dedupChanged, posted: []Alert{firing("Disk")}, alerts: []Alert{resolved("Disk")}, want: []string{"Disk"}, status: "resolved", changed: true},
+		{name: "resolved never posted", policy: dedupChanged, alerts: []Alert{resolved("Disk")}, want: []string{"Disk"}, status: "resolved", changed: false},
+		{
+			name: "only the new ones", policy: dedupChanged,
+			posted: []Alert{firing("Disk"), firing("CPU")},
+			alerts: []Alert{firing("Disk"), resolved("CPU"), firing("Memory")},
+			want:   []string{"CPU", "Memory"}, status: "firing", changed: true,
+		},
+		{
+			name: "edited message keeps the group", policy: dedupChanged, edit: true,
+			posted: []Alert{firing("Disk")},
+			alerts: []Alert{firing("Disk"), firing("Memory")},
+			want:   []string{"Disk", "Memory"}, status: "firing", changed: true,
+		},
+		{
+			name: "notifier shows the changes", policy: dedupChanged, edit: true, notifier: "slack",
+			posted: []Alert{firing("Disk")},
+			alerts: []Alert{firing("Disk"), firing("Memory")},
+			want:   []string{"Memory"}, status: "firing", changed: true,
+		},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := &Config{EditMessages: tt.edit}
+			cfg.Dedup.Policy = tt.policy
+			cfg.Dedup.ReminderInterval = tt.reminder
+			useConfig(cfg)
+
+			chatid := int64(-23000 - i)
+			if len(tt.posted) > 0 {
+				d := &Delivery{ChatID: chatid, Notifier: tt.notifier, Alerts: Alerts{Alerts: tt.posted}}
+				recordAlerts(d)
+				if tt.sentAgo > 0 {
+					for _, a := range tt.posted {
+						key := alertKey(d.chat(), 0, a.fingerprint())
+						var rec AlertRecord
+						store.Get(bucketAlerts, key, &rec)
+						rec.LastSentAt = time.Now().Add(-tt.sentAgo)
+						store.Put(bucketAlerts, key, rec)
+					}
+				}
+			}
+
+			alerts := Alerts{Status: "firing", Alerts: tt.alerts}
+			got, changed := changedAlerts(chatid, 0, tt.notifier, alerts)
+			var names []string
+			for _, a := range got.Alerts {
+				names = append(names, a.Labels["alertname"])
+			}
+			if changed != tt.changed || !reflect.DeepEqual(names, tt.want) || (changed && got.Status != tt.status) {
+				t.Errorf("changedAlerts() = %v %s, %v, want %v %s, %v", names, got.Status, changed, tt.want, tt.status, tt.changed)
+			}
+		})
+	}
+}
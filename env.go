@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Prefix of the environment variables overriding settings, like
+// PROMETHEUS_BOT_TIME_ZONE for time_zone or PROMETHEUS_BOT_ALERTMANAGER_URL
+// for alertmanager.url
+const envPrefix = "PROMETHEUS_BOT_"
+
+var envRefRE = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// resolveConfig applies the environment to the configuration document
+// before it is decoded: ${VAR} references in values, then <key>_file keys
+// read from files, then the PROMETHEUS_BOT_* variables, which override the
+// file.
+func resolveConfig(doc *yaml.Node) []error {
+	var problems []error
+	root := doc.Content[0]
+
+	expandEnv(root, &problems)
+	readSecretFiles(root, reflect.TypeOf(Config{}), &problems)
+	applyEnv(root, reflect.TypeOf(Config{}), envPrefix, &problems)
+
+	return problems
+}
+
+// expandEnv replaces ${VAR} in the scalar values under node.
+func expandEnv(node *yaml.Node, problems *[]error) {
+	if node.Kind == yaml.ScalarNode {
+		if !envRefRE.MatchString(node.Value) {
+			return
+		}
+		node.Value = envRefRE.ReplaceAllStringFunc(node.Value, func(ref string) string {
+			name := envRefRE.FindStringSubmatch(ref)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				*problems = append(*problems, fmt.Errorf("line %d: environment variable %s is not set", node.Line, name))
+			}
+			return value
+		})
+		if node.Style == 0 {
+			// The value decides the type again, ${PORT} can be a number
+			node.Tag = ""
+		}
+		return
+	}
+
+	for i, child := range node.Content {
+		// Keys of mappings are left alone
+		if node.Kind == yaml.MappingNode && i%2 == 0 {
+			continue
+		}
+		expandEnv(child, problems)
+	}
+}
+
+// readSecretFiles replaces the <key>_file keys under node, which has type
+// t, by <key> set to the content of the file without the trailing newline.
+// Settings that end in _file themselves, like tls.cert_file, are kept.
+func readSecretFiles(node *yaml.Node, t reflect.Type, problems *[]error) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if isUnmarshaler(t) {
+		return
+	}
+
+	switch {
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := yamlFields(t)
+		for i := 0; i < len(node.Content); i += 2 {
+			key, value := node.Content[i], node.Content[i+1]
+			if field, ok := fields[key.Value]; ok {
+				readSecretFiles(value, field.Type, problems)
+				continue
+			}
+			name, ok := strings.CutSuffix(key.Value, "_file")
+			if _, known := fields[name]; !ok || !known || value.Kind != yaml.ScalarNode {
+				continue
+			}
+			if mappingValue(node, name) != nil {
+				*problems = append(*problems, fmt.Errorf("line %d: %s and %s are both set", key.Line, name, key.Value))
+				continue
+			}
+			content, err := os.ReadFile(value.Value)
+			if err != nil {
+				*problems = append(*problems, fmt.Errorf("line %d: %s: %w", key.Line, key.Value, err))
+				continue
+			}
+			key.Value = name
+			*value = yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: strings.TrimRight(string(content), "\r\n"), Line: value.Line}
+		}
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			readSecretFiles(node.Content[i], t.Elem(), problems)
+		}
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for _, item := range node.Content {
+			readSecretFiles(item, t.Elem(), problems)
+		}
+	}
+}
+
+// applyEnv sets the settings of type t found in the environment under the
+// prefix, and <prefix>_FILE to read them from a file. Settings that are not
+// a single value, like chats or routes, are given in YAML.
+func applyEnv(node *yaml.Node, t reflect.Type, prefix string, problems *[]error) {
+	for name, field := range yamlFields(t) {
+		env := prefix + strings.ToUpper(name)
+
+		if field.Type.Kind() == reflect.Struct && !isUnmarshaler(field.Type) {
+			child := mappingValue(node, name)
+			if child == nil || child.Kind != yaml.MappingNode {
+				child = &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+			}
+			applyEnv(child, field.Type, env+"_", problems)
+			if len(child.Content) > 0 {
+				setMappingValue(node, name, child)
+			}
+			continue
+		}
+
+		value, ok := os.LookupEnv(env)
+		if file, isSet := os.LookupEnv(env + "_FILE"); isSet && !ok {
+			content, err := os.ReadFile(file)
+			if err != nil {
+				*problems = append(*problems, fmt.Errorf("%s_FILE: %w", env, err))
+				continue
+			}
+			value, ok = strings.TrimRight(string(content), "\r\n"), true
+		}
+		if !ok {
+			continue
+		}
+
+		switch field.Type.Kind() {
+		case reflect.String:
+			setMappingValue(node, name, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value})
+		case reflect.Slice, reflect.Map, reflect.Struct:
+			var doc yaml.Node
+			if err := yaml.Unmarshal([]byte(value), &doc); err != nil || len(doc.Content) == 0 {
+				*problems = append(*problems, fmt.Errorf("%s is not valid YAML: %v", env, err))
+				continue
+			}
+			setMappingValue(node, name, doc.Content[0])
+		default:
+			setMappingValue(node, name, &yaml.Node{Kind: yaml.ScalarNode, Value: value})
+		}
+	}
+}
+
+// unknownSettings returns the keys under node that are no field of type t.
+func unknownSettings(node *yaml.Node, t reflect.Type) []error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if isUnmarshaler(t) {
+		return nil
+	}
+
+	var problems []error
+	switch {
+	case t.Kind() == reflect.Struct && node.Kind == yaml.MappingNode:
+		fields := yamlFields(t)
+		for i := 0; i < len(node.Content); i += 2 {
+			key := node.Content[i]
+			field, ok := fields[key.Value]
+			if !ok {
+				problems = append(problems, fmt.Errorf("line %d: unknown setting %s", key.Line, key.Value))
+				continue
+			}
+			problems = append(problems, unknownSettings(node.Content[i+1], field.Type)...)
+		}
+	case t.Kind() == reflect.Map && node.Kind == yaml.MappingNode:
+		for i := 1; i < len(node.Content); i += 2 {
+			problems = append(problems, unknownSettings(node.Content[i], t.Elem())...)
+		}
+	case t.Kind() == reflect.Slice && node.Kind == yaml.SequenceNode:
+		for _, item := range node.Content {
+			problems = append(problems, unknownSettings(item, t.Elem())...)
+		}
+	}
+	return problems
+}
+
+// yamlFields returns the fields of a struct type by YAML key.
+func yamlFields(t reflect.Type) map[string]reflect.StructField {
+	fields := map[string]reflect.StructField{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "" || name == "-" || !field.IsExported() {
+			continue
+		}
+		fields[name] = field
+	}
+	return fields
+}
+
+func isUnmarshaler(t reflect.Type) bool {
+	return reflect.PointerTo(t).Implements(reflect.TypeOf((*yaml.Unmarshaler)(nil)).Elem())
+}
+
+// mappingValue returns the value of key in a mapping node, or nil.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setMappingValue sets the value of key in a mapping node.
+func setMappingValue(node *yaml.Node, key string, value *yaml.Node) {
+	for i := 0; i < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			node.Content[i+1] = value
+			return
+		}
+	}
+	node.Content = append(node.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, value)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDecodeConfigEnv(t *testing.T) {
+	dir := t.TempDir()
+	secret := writeFile(t, dir, "secret", "from-file\n")
+	missing := dir + "/missing"
+
+	tests := []struct {
+		name    string
+		content string
+		env     map[string]string
+		// The setting checked, from the decoded configuration
+		got  func(c *Config) any
+		want any
+		// Part of a problem, the setting is not checked
+		problem string
+	}{
+		{
+			name:    "variable",
+			content: "time_zone: ${TEST_TZ}",
+			env:     map[string]string{"TEST_TZ": "Europe/Paris"},
+			got:     func(c *Config) any { return c.TimeZone },
+			want:    "Europe/Paris",
+		},
+		{
+			name:    "variable in a value",
+			content: "alertmanager:\n  url: http://${TEST_HOST}:9093",
+			env:     map[string]string{"TEST_HOST": "am"},
+			got:     func(c *Config) any { return c.Alertmanager.URL },
+			want:    "http://am:9093",
+		},
+		{
+			name:    "unset variable",
+			content: "time_zone: ${TEST_UNSET}",
+			problem: "environment variable TEST_UNSET is not set",
+		},
+		{
+			name:    "unquoted number",
+			content: "split_msg_byte: ${TEST_SPLIT}",
+			env:     map[string]string{"TEST_SPLIT": "1000"},
+			got:     func(c *Config) any { return c.SplitMessageBytes },
+			want:    1000,
+		},
+		{
+			name:    "quoted number stays a string",
+			content: `split_msg_byte: "${TEST_SPLIT}"`,
+			env:     map[string]string{"TEST_SPLIT": "1000"},
+			problem: "!!str `1000` into int",
+		},
+		{
+			name:    "secret file",
+			content: "telegram_token_file: " + secret,
+			got:     func(c *Config) any { return c.TelegramToken },
+			want:    "from-file",
+		},
+		{
+			name:    "nested secret file",
+			content: "alertmanager:\n  password_file: " + secret,
+			got:     func(c *Config) any { return c.Alertmanager.Password },
+			want:    "from-file",
+		},
+		{
+			name:    "secret file and value",
+			content: "telegram_token: x\ntelegram_token_file: " + secret,
+			problem: "telegram_token and telegram_token_file are both set",
+		},
+		{
+			name:    "missing secret file",
+			content: "telegram_token_file: " + missing,
+			problem: "telegram_token_file: open " + missing,
+		},
+		{
+			name:    "setting ending in _file",
+			content: "tls:\n  cert_file: /etc/bot/cert.pem",
+			got:     func(c *Config) any { return c.TLS.CertFile },
+			want:    "/etc/bot/cert.pem",
+		},
+		{
+			name: "environment",
+			env:  map[string]string{envPrefix + "TIME_ZONE": "Europe/Paris"},
+			got:  func(c *Config) any { return c.TimeZone },
+			want: "Europe/Paris",
+		},
+		{
+			name:    "nested environment",
+			content: "alertmanager:\n  username: bot",
+			env:     map[string]string{envPrefix + "ALERTMANAGER_URL": "http://am:9093"},
+			got:     func(c *Config) any { return c.Alertmanager.URL + " " + c.Alertmanager.Username },
+			want:    "http://am:9093 bot",
+		},
+		{
+			name:    "environment overrides the file",
+			content: "alertmanager:\n  url: http://file:9093",
+			env:     map[string]string{envPrefix + "ALERTMANAGER_URL": "http://env:9093"},
+			got:     func(c *Config) any { return c.Alertmanager.URL },
+			want:    "http://env:9093",
+		},
+		{
+			name: "environment number",
+			env:  map[string]string{envPrefix + "SPLIT_MSG_BYTE": "1000"},
+			got:  func(c *Config) any { return c.SplitMessageBytes },
+			want: 1000,
+		},
+		{
+			name: "environment YAML",
+			env:  map[string]string{envPrefix + "ALERTMANAGER_SILENCE_DURATIONS": "[1h, 4h]"},
+			got:  func(c *Config) any { return fmt.Sprint(c.Alertmanager.SilenceDurations) },
+			want: fmt.Sprint([]time.Duration{time.Hour, 4 * time.Hour}),
+		},
+		{
+			name: "environment file",
+			env:  map[string]string{envPrefix + "ALERTMANAGER_PASSWORD_FILE": secret},
+			got:  func(c *Config) any { return c.Alertmanager.Password },
+			want: "from-file",
+		},
+		{
+			name: "environment before its file",
+			env:  map[string]string{envPrefix + "ALERTMANAGER_PASSWORD": "from-env", envPrefix + "ALERTMANAGER_PASSWORD_FILE": secret},
+			got:  func(c *Config) any { return c.Alertmanager.Password },
+			want: "from-env",
+		},
+		{
+			name:    "missing environment file",
+			env:     map[string]string{envPrefix + "ALERTMANAGER_PASSWORD_FILE": missing},
+			problem: envPrefix + "ALERTMANAGER_PASSWORD_FILE: open " + missing,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			var c Config
+			problems, err := decodeConfig([]byte(tt.content), &c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.problem != "" {
+				if got := errors.Join(problems...); got == nil || !strings.Contains(got.Error(), tt.problem) {
+					t.Errorf("decodeConfig() problems = %v, want %q", got, tt.problem)
+				}
+				return
+			}
+			if len(problems) > 0 {
+				t.Fatalf("decodeConfig() problems = %v", problems)
+			}
+			if got := tt.got(&c); got != tt.want {
+				t.Errorf("setting = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	dir := t.TempDir()
+	fromFile := writeFile(t, dir, "file.tmpl", "file")
+	fromEnv := writeFile(t, dir, "env.tmpl", "env")
+	fromFlag := writeFile(t, dir, "flag.tmpl", "flag")
+	base := "telegram_token: x\ntime_zone: UTC\n"
+
+	tests := []struct {
+		name    string
+		content string
+		env     string
+		flag    string
+		want    string
+	}{
+		{name: "default", content: base},
+		{name: "file", content: base + "template_path: " + fromFile, want: fromFile},
+		{name: "environment", content: base + "template_path: " + fromFile, env: fromEnv, want: fromEnv},
+		{name: "flag", content: base + "template_path: " + fromFile, env: fromEnv, flag: fromFlag, want: fromFlag},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv(envPrefix+"TEMPLATE_PATH", tt.env)
+			}
+			prev := *template_path
+			defer func() { *template_path = prev }()
+			*template_path = tt.flag
+
+			useConfigFile(t, tt.content)
+			c, _, _, err := loadConfig(true)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c.TemplatePath != tt.want {
+				t.Errorf("template_path = %q, want %q", c.TemplatePath, tt.want)
+			}
+		})
+	}
+}
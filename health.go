@@ -0,0 +1,192 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// How often Telegram is checked with getMe, and how long a successful
+	// check keeps the bot ready
+	telegramCheckInterval = 30 * time.Second
+	telegramCheckMaxAge   = 2 * time.Minute
+	// Share of queue.max_size above which the queue is saturated
+	queueSaturation = 0.9
+)
+
+var telegramCheck struct {
+	sync.Mutex
+	lastOK    time.Time
+	lastError string
+}
+
+// markTelegramOK records a successful Telegram API call.
+func markTelegramOK() {
+	telegramCheck.Lock()
+	defer telegramCheck.Unlock()
+	telegramCheck.lastOK = time.Now()
+	telegramCheck.lastError = ""
+}
+
+// checkTelegram calls getMe periodically, so /ready knows Telegram is reachable.
+func checkTelegram() {
+	for range time.Tick(telegramCheckInterval) {
+		_, err := current().bot.GetMe()
+		if err == nil {
+			markTelegramOK()
+			continue
+		}
+		slog.Warn("Telegram check failed", "error", err)
+		telegramCheck.Lock()
+		telegramCheck.lastError = err.Error()
+		telegramCheck.Unlock()
+	}
+}
+
+type readinessCheck struct {
+	OK     bool   `json:"ok"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// GET_Health tells the process is alive.
+func GET_Health(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status": "ok",
+		"uptime": time.Since(startTime).Round(time.Second).String(),
+	})
+}
+
+// GET_Ready tells whether the bot can deliver alerts, without sending anything to Telegram.
+func GET_Ready(c *gin.Context) {
+	s := current()
+	cfg := s.cfg
+	checks := map[string]readinessCheck{}
+
+	telegramCheck.Lock()
+	age := time.Since(telegramCheck.lastOK)
+	switch {
+	case s.bot == nil:
+		checks["telegram"] = readinessCheck{false, "token not authorised yet"}
+	case telegramCheck.lastOK.IsZero():
+		checks["telegram"] = readinessCheck{false, "getMe never succeeded"}
+	case age > telegramCheckMaxAge:
+		checks["telegram"] = readinessCheck{false, fmt.Sprintf("last successful getMe %s ago: %s", age.Round(time.Second), telegramCheck.lastError)}
+	default:
+		checks["telegram"] = readinessCheck{true, fmt.Sprintf("last successful getMe %s ago", age.Round(time.Second))}
+	}
+	telegramCheck.Unlock()
+
+	checks["template"] = templatesCheck(s)
+
+	if err := store.Ping(); err != nil {
+		checks["storage"] = readinessCheck{false, err.Error()}
+	} else {
+		checks["storage"] = readinessCheck{true, ""}
+	}
+
+	depth := queue.Depth()
+	detail := fmt.Sprintf("%d of %d messages", depth, cfg.Queue.MaxSize)
+	checks["queue"] = readinessCheck{float64(depth) < queueSaturation*float64(cfg.Queue.MaxSize), detail}
+
+	status, code := "ready", http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			status, code = "not ready", http.StatusServiceUnavailable
+		}
+	}
+	c.JSON(code, gin.H{
+		"status": status,
+		"checks": checks,
+	})
+}
+
+// templatesCheck tells whether the template file and every named template
+// of the configuration are parsed.
+func templatesCheck(s *snapshot) readinessCheck {
+	if s.cfg.TemplatePath != "" && s.tmpl == nil {
+		return readinessCheck{false, "template " + s.cfg.TemplatePath + " is not parsed"}
+	}
+	var missing []string
+	for name := range s.cfg.templateFiles {
+		if s.templates[name] == nil {
+			missing = append(missing, name)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return readinessCheck{false, "templates not parsed: " + strings.Join(missing, ", ")}
+	}
+	return readinessCheck{true, fmt.Sprintf("%d templates", len(s.templates))}
+}
+
+// runHealthcheck queries /health of a running bot, for container health
+// checks in images without curl or wget. The TLS settings come from the
+// config file; the bot checks itself, so its certificate is not verified.
+func runHealthcheck(addr string) int {
+	var tlsCfg TLSConfig
+	if c, _, _, err := loadConfig(false); err == nil {
+		tlsCfg = c.TLS
+	}
+	return checkHealth(addr, tlsCfg)
+}
+
+// checkHealth queries /health on the listen address with the TLS settings of
+// the listener.
+
+func checkHealth(addr string, tlsCfg TLSConfig) int {
+
+	host := "localhost"
+	if _, ok := unixSocketPath(addr); !ok {
+		h, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 1
+		}
+		if h == "" || h == "0.0.0.0" || h == "::" {
+			h = "127.0.0.1"
+		}
+		host = net.JoinHostPort(h, port)
+	}
+
+	transport := &http.Transport{DialContext: dialer(addr)}
+	scheme := "http"
+	if tlsCfg.enabled() {
+		scheme = "https"
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+		if tlsCfg.ClientCAFile != "" {
+			if tlsCfg.HealthcheckCertFile == "" {
+				fmt.Fprintln(os.Stderr, "the listener requires client certificates, set tls.healthcheck_cert_file and tls.healthcheck_key_file")
+				return 1
+			}
+			cert, err := tls.LoadX509KeyPair(tlsCfg.HealthcheckCertFile, tlsCfg.HealthcheckKeyFile)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				return 1
+			}
+			transport.TLSClientConfig.Certificates = []tls.Certificate{cert}
+		}
+	}
+
+	client := http.Client{Timeout: 5 * time.Second, Transport: transport}
+	resp, err := client.Get(scheme + "://" + host + "/health")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		fmt.Fprintln(os.Stderr, "health check failed:", resp.Status)
+		return 1
+	}
+	return 0
+}
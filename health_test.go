@@ -0,0 +1,42 @@
+package main
+
+import (
+	"html/template"
+	"testing"
+)
+
+func TestTemplatesCheck(t *testing.T) {
+	parsed := template.Must(template.New("").Parse("{{ .Status }}"))
+	tests := []struct {
+		name string
+		s    *snapshot
+		want bool
+	}{
+		{"no templates", &snapshot{cfg: &Config{}}, true},
+		{"template file parsed", &snapshot{cfg: &Config{TemplatePath: "default.tmpl"}, tmpl: parsed}, true},
+		{"template file missing", &snapshot{cfg: &Config{TemplatePath: "default.tmpl"}}, false},
+		{
+			"named templates parsed",
+			&snapshot{
+				cfg:       &Config{templateFiles: map[string]string{"short": "short.tmpl"}},
+				templates: map[string]*template.Template{"short": parsed},
+			},
+			true,
+		},
+		{
+			"named template missing",
+			&snapshot{
+				cfg:       &Config{templateFiles: map[string]string{"short": "short.tmpl", "long": "long.tmpl"}},
+				templates: map[string]*template.Template{"short": parsed},
+			},
+			false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := templatesCheck(tt.s); got.OK != tt.want {
+				t.Errorf("templatesCheck() = %+v, want ok %v", got, tt.want)
+			}
+		})
+	}
+}
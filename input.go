@@ -0,0 +1,200 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// decodeFunc decodes the webhook payload of a source into alerts.
+type decodeFunc func(body io.Reader) (Alerts, error)
+
+// Input adapters by the first segment of their routes, /<name>,
+// /<name>/:chatid and /<name>/:chatid/:topicid
+var inputAdapters = map[string]decodeFunc{
+	"alert":   decodeAlertmanager,
+	"grafana": decodeGrafana,
+	"generic": decodeGeneric,
+}
+
+// inputAdapter returns the adapter of the route of a request.
+func inputAdapter(c *gin.Context) decodeFunc {
+	name, _, _ := strings.Cut(strings.TrimPrefix(c.FullPath(), "/"), "/")
+	if decode, ok := inputAdapters[name]; ok {
+		return decode
+	}
+	return decodeAlertmanager
+}
+
+func decodeAlertmanager(body io.Reader) (Alerts, error) {
+	var alerts Alerts
+	err := json.NewDecoder(body).Decode(&alerts)
+	return alerts, err
+}
+
+// grafanaWebhook is the webhook of Grafana unified alerting, the Alertmanager
+// one with a few more fields.
+type grafanaWebhook struct {
+	Receiver          string            `json:"receiver"`
+	Status            string            `json:"status"`
+	OrgID             int64             `json:"orgId"`
+	Alerts            []grafanaAlert    `json:"alerts"`
+	GroupLabels       map[string]string `json:"groupLabels"`
+	CommonLabels      map[string]string `json:"commonLabels"`
+	CommonAnnotations map[string]string `json:"commonAnnotations"`
+	ExternalURL       string            `json:"externalURL"`
+	Version           string            `json:"version"`
+	GroupKey          string            `json:"groupKey"`
+	TruncatedAlerts   int               `json:"truncatedAlerts"`
+	Title             string            `json:"title"`
+	State             string            `json:"state"`
+	Message           string            `json:"message"`
+}
+
+type grafanaAlert struct {
+	Alert
+	SilenceURL   string `json:"silenceURL"`
+	DashboardURL string `json:"dashboardURL"`
+	PanelURL     string `json:"panelURL"`
+	ImageURL     string `json:"imageURL"`
+	ValueString  string `json:"valueString"`
+}
+
+// decodeGrafana keeps the Grafana title, message, links and values as
+// annotations, so templates and alert_buttons can use them.
+func decodeGrafana(body io.Reader) (Alerts, error) {
+	var webhook grafanaWebhook
+	if err := json.NewDecoder(body).Decode(&webhook); err != nil {
+		return Alerts{}, err
+	}
+
+	orgID := ""
+	if webhook.OrgID != 0 {
+		orgID = strconv.FormatInt(webhook.OrgID, 10)
+	}
+	alerts := Alerts{
+		GroupKey:        webhook.GroupKey,
+		TruncatedAlerts: webhook.TruncatedAlerts,
+		Status:          webhook.Status,
+		Receiver:        webhook.Receiver,
+		GroupLabels:     webhook.GroupLabels,
+		CommonLabels:    webhook.CommonLabels,
+		CommonAnnotations: grafanaAnnotations(webhook.CommonAnnotations, map[string]string{
+			"title":   webhook.Title,
+			"message": webhook.Message,
+			"state":   webhook.State,
+			"orgId":   orgID,
+		}),
+		ExternalURL: webhook.ExternalURL,
+	}
+	for _, ga := range webhook.Alerts {
+		alert := ga.Alert
+		alert.Annotations = grafanaAnnotations(alert.Annotations, map[string]string{
+			"silenceURL":   ga.SilenceURL,
+			"dashboardURL": ga.DashboardURL,
+			"panelURL":     ga.PanelURL,
+			"imageURL":     ga.ImageURL,
+			"valueString":  ga.ValueString,
+		})
+		alerts.Alerts = append(alerts.Alerts, alert)
+	}
+	return alerts, nil
+}
+
+// grafanaAnnotations adds the set Grafana fields to annotations, the
+// annotations of the same name win.
+func grafanaAnnotations(annotations map[string]string, fields map[string]string) map[string]string {
+	merged := make(map[string]string, len(annotations)+len(fields))
+	for k, v := range fields {
+		if v != "" {
+			merged[k] = v
+		}
+	}
+	for k, v := range annotations {
+		merged[k] = v
+	}
+	return merged
+}
+
+// genericNotification is a single notification from scripts or CI
+// pipelines. Only title is required.
+type genericNotification struct {
+	// The alertname label
+	Title string `json:"title"`
+	// firing by default
+	Status   string `json:"status"`
+	Severity string `json:"severity"`
+	// The summary annotation
+	Message string `json:"message"`
+	URL     string `json:"url"`
+	// The receiver, generic by default
+	Source string `json:"source"`
+	// Identifies the notification so resolving it edits or deduplicates the
+	// same one, the labels by default
+	ID          string            `json:"id"`
+	Labels      map[string]string `json:"labels"`
+	Annotations map[string]string `json:"annotations"`
+	// Now by default
+	StartsAt time.Time `json:"startsAt"`
+	EndsAt   time.Time `json:"endsAt"`
+}
+
+func decodeGeneric(body io.Reader) (Alerts, error) {
+	var n genericNotification
+	if err := json.NewDecoder(body).Decode(&n); err != nil {
+		return Alerts{}, err
+	}
+
+	labels := map[string]string{}
+	for k, v := range n.Labels {
+		labels[k] = v
+	}
+	if n.Title != "" {
+		labels["alertname"] = n.Title
+	}
+	if labels["alertname"] == "" {
+		return Alerts{}, PayloadProblem{"title", "missing"}
+	}
+	if n.Severity != "" {
+		labels["severity"] = n.Severity
+	}
+	annotations := map[string]string{}
+	for k, v := range n.Annotations {
+		annotations[k] = v
+	}
+	if n.Message != "" {
+		annotations["summary"] = n.Message
+	}
+	if n.Status == "" {
+		n.Status = "firing"
+	}
+	if n.Source == "" {
+		n.Source = "generic"
+	}
+	if n.StartsAt.IsZero() {
+		n.StartsAt = time.Now()
+	}
+
+	alert := Alert{
+		Status:       n.Status,
+		Labels:       labels,
+		Annotations:  annotations,
+		StartsAt:     n.StartsAt,
+		EndsAt:       n.EndsAt,
+		GeneratorURL: n.URL,
+		Fingerprint:  n.ID,
+	}
+	return Alerts{
+		GroupKey:          n.Source + "/" + alert.fingerprint(),
+		Status:            n.Status,
+		Receiver:          n.Source,
+		GroupLabels:       map[string]string{"alertname": labels["alertname"]},
+		CommonLabels:      labels,
+		CommonAnnotations: annotations,
+		Alerts:            []Alert{alert},
+	}, nil
+}
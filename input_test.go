@@ -0,0 +1,113 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDecodeGrafana(t *testing.T) {
+	body := `{
+		"receiver": "ops", "status": "firing", "orgId": 1, "groupKey": "{}:{alertname=\"Disk\"}",
+		"title": "[FIRING:1] Disk", "message": "Disk is full", "state": "alerting",
+		"commonAnnotations": {"summary": "disk", "title": "Custom title"},
+		"alerts": [{
+			"status": "firing", "labels": {"alertname": "Disk"}, "annotations": {"panelURL": "kept"},
+			"startsAt": "2024-01-01T00:00:00Z",
+			"silenceURL": "https://grafana/silence", "panelURL": "https://grafana/panel", "valueString": "[ var='A' value=97 ]"
+		}]
+	}`
+	alerts, err := decodeGrafana(strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	wantCommon := map[string]string{"summary": "disk", "title": "Custom title", "message": "Disk is full", "state": "alerting", "orgId": "1"}
+	if !reflect.DeepEqual(alerts.CommonAnnotations, wantCommon) {
+		t.Errorf("CommonAnnotations = %v, want %v", alerts.CommonAnnotations, wantCommon)
+	}
+	if alerts.Receiver != "ops" || alerts.GroupKey != `{}:{alertname="Disk"}` || len(alerts.Alerts) != 1 {
+		t.Fatalf("decodeGrafana() = %+v", alerts)
+	}
+	wantAlert := map[string]string{"silenceURL": "https://grafana/silence", "panelURL": "kept", "valueString": "[ var='A' value=97 ]"}
+	if got := alerts.Alerts[0].Annotations; !reflect.DeepEqual(got, wantAlert) {
+		t.Errorf("alert annotations = %v, want %v", got, wantAlert)
+	}
+	if problems := validateAlerts(alerts); len(problems) > 0 {
+		t.Errorf("validateAlerts() = %v", problems)
+	}
+}
+
+func TestDecodeGeneric(t *testing.T) {
+	tests := []struct {
+		name        string
+		body        string
+		problem     string
+		status      string
+		receiver    string
+		labels      map[string]string
+		annotations map[string]string
+		fingerprint string
+	}{
+		{
+			name:        "title only",
+			body:        `{"title": "Deploy failed"}`,
+			status:      "firing",
+			receiver:    "generic",
+			labels:      map[string]string{"alertname": "Deploy failed"},
+			annotations: map[string]string{},
+			fingerprint: labelsFingerprint(map[string]string{"alertname": "Deploy failed"}),
+		},
+		{
+			name:        "all fields",
+			body:        `{"title": "Deploy failed", "status": "resolved", "severity": "critical", "message": "job 42", "source": "ci", "id": "deploy-42", "labels": {"env": "prod"}}`,
+			status:      "resolved",
+			receiver:    "ci",
+			labels:      map[string]string{"alertname": "Deploy failed", "severity": "critical", "env": "prod"},
+			annotations: map[string]string{"summary": "job 42"},
+			fingerprint: "deploy-42",
+		},
+		{
+			name:        "alertname label",
+			body:        `{"labels": {"alertname": "Backup"}}`,
+			status:      "firing",
+			receiver:    "generic",
+			labels:      map[string]string{"alertname": "Backup"},
+			annotations: map[string]string{},
+			fingerprint: labelsFingerprint(map[string]string{"alertname": "Backup"}),
+		},
+		{name: "no title", body: `{"message": "?"}`, problem: "title"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alerts, err := decodeGeneric(strings.NewReader(tt.body))
+			if tt.problem != "" {
+				var problem PayloadProblem
+				if !errors.As(err, &problem) || problem.Field != tt.problem {
+					t.Errorf("decodeGeneric() = %v, want a problem with %s", err, tt.problem)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			alert := alerts.Alerts[0]
+			if alerts.Status != tt.status || alerts.Receiver != tt.receiver || alert.Status != tt.status {
+				t.Errorf("status, receiver = %s %s, want %s %s", alerts.Status, alerts.Receiver, tt.status, tt.receiver)
+			}
+			if !reflect.DeepEqual(alert.Labels, tt.labels) || !reflect.DeepEqual(alert.Annotations, tt.annotations) {
+				t.Errorf("labels, annotations = %v %v, want %v %v", alert.Labels, alert.Annotations, tt.labels, tt.annotations)
+			}
+			if alert.fingerprint() != tt.fingerprint || alerts.GroupKey != tt.receiver+"/"+tt.fingerprint {
+				t.Errorf("fingerprint, group key = %s %s, want %s", alert.fingerprint(), alerts.GroupKey, tt.fingerprint)
+			}
+			if alert.StartsAt.IsZero() {
+				t.Error("startsAt is not set")
+			}
+			if problems := validateAlerts(alerts); len(problems) > 0 {
+				t.Errorf("validateAlerts() = %v", problems)
+			}
+		})
+	}
+}
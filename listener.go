@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TLSConfig serves the webhooks over HTTPS. The files are read again when
+// they change, so renewed certificates are picked up without a restart.
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+	// Clients must present a certificate signed by this CA bundle
+	ClientCAFile string `yaml:"client_ca_file"`
+	// Client certificate of -healthcheck when client_ca_file is set
+	HealthcheckCertFile string `yaml:"healthcheck_cert_file"`
+	HealthcheckKeyFile  string `yaml:"healthcheck_key_file"`
+}
+
+func (t TLSConfig) enabled() bool {
+	return t.CertFile != "" || t.KeyFile != ""
+}
+
+// unixSocketPath returns the socket of a listen address like unix:/run/bot.sock.
+func unixSocketPath(addr string) (string, bool) {
+	return strings.CutPrefix(addr, "unix:")
+}
+
+// socketMode parses the listen_mode permissions, 0 keeps the ones the umask
+// gives.
+func socketMode(mode string) (os.FileMode, error) {
+	if mode == "" {
+		return 0, nil
+	}
+	perm, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || perm == 0 || perm > 0o777 {
+		return 0, fmt.Errorf("listen_mode %q is not octal permissions like 0660", mode)
+	}
+	return os.FileMode(perm), nil
+}
+
+// listen opens the listener of the webhooks, a TCP address or a Unix socket
+// with the given permissions, with TLS when it is configured.
+func listen(addr string, mode os.FileMode, tlsCfg TLSConfig) (net.Listener, error) {
+	var ln net.Listener
+	var err error
+	if path, ok := unixSocketPath(addr); ok {
+		// A socket left by a previous run would make listen fail
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return nil, err
+		}
+		ln, err = net.Listen("unix", path)
+		if err == nil && mode != 0 {
+			if err = os.Chmod(path, mode); err != nil {
+				ln.Close()
+				return nil, err
+			}
+		}
+	} else {
+		ln, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if !tlsCfg.enabled() {
+		return ln, nil
+	}
+	certs := &certReloader{files: tlsCfg}
+	if _, err := certs.config(); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return tls.NewListener(ln, &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return certs.config()
+		},
+	}), nil
+}
+
+// certReloader keeps the TLS settings built from the certificate files, and
+// builds them again when a file is modified.
+type certReloader struct {
+	files TLSConfig
+
+	mu      sync.Mutex
+	tls     *tls.Config
+	modTime time.Time
+}
+
+func (r *certReloader) config() (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	modTime, err := r.latestModTime()
+	if err != nil {
+		if r.tls != nil {
+			slog.Error("Can't check TLS files, keeping the loaded certificate", "error", err)
+			return r.tls, nil
+		}
+		return nil, err
+	}
+	if r.tls != nil && !modTime.After(r.modTime) {
+		return r.tls, nil
+	}
+
+	config, err := r.load()
+	if err != nil {
+		if r.tls != nil {
+			slog.Error("Can't reload TLS files, keeping the loaded certificate", "error", err)
+			return r.tls, nil
+		}
+		return nil, err
+	}
+	if r.tls != nil {
+		slog.Info("TLS certificate reloaded", "cert", r.files.CertFile)
+	}
+	r.tls, r.modTime = config, modTime
+	return r.tls, nil
+}
+
+func (r *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{r.files.CertFile, r.files.KeyFile, r.files.ClientCAFile} {
+		if file == "" {
+			continue
+		}
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (r *certReloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.files.CertFile, r.files.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if r.files.ClientCAFile != "" {
+		pem, err := os.ReadFile(r.files.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", r.files.ClientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// dialer connects to the bot on its listen address, for the health check.
+func dialer(addr string) func(ctx context.Context, network, address string) (net.Conn, error) {
+	var d net.Dialer
+	if path, ok := unixSocketPath(addr); ok {
+		return func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return d.DialContext(ctx, "unix", path)
+		}
+	}
+	return d.DialContext
+}
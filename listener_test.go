@@ -0,0 +1,129 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSocketMode(t *testing.T) {
+	tests := []struct {
+		mode    string
+		want    os.FileMode
+		wantErr bool
+	}{
+		{mode: "", want: 0},
+		{mode: "0660", want: 0o660},
+		{mode: "600", want: 0o600},
+		{mode: "0", wantErr: true},
+		{mode: "0800", wantErr: true},
+		{mode: "1777", wantErr: true},
+		{mode: "rw-rw----", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := socketMode(tt.mode)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("socketMode(%q) = %v, %v, want %v, error %v", tt.mode, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestListenSocketMode(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bot.sock")
+	ln, err := listen("unix:"+path, 0o660, TLSConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o660 {
+		t.Errorf("socket mode = %v, want 0660", info.Mode().Perm())
+	}
+}
+
+func TestHealthcheckMutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey := newTestCert(t, dir, "ca", nil, nil)
+	newTestCert(t, dir, "server", ca, caKey)
+	newTestCert(t, dir, "healthcheck", ca, caKey)
+
+	tlsCfg := TLSConfig{
+		CertFile:     filepath.Join(dir, "server.crt"),
+		KeyFile:      filepath.Join(dir, "server.key"),
+		ClientCAFile: filepath.Join(dir, "ca.crt"),
+	}
+	addr := "unix:" + filepath.Join(dir, "bot.sock")
+	ln, err := listen(addr, 0, tlsCfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})}
+	go server.Serve(ln)
+	defer server.Close()
+
+	if code := checkHealth(addr, tlsCfg); code == 0 {
+		t.Error("checkHealth() without a client certificate = 0, want a failure")
+	}
+
+	tlsCfg.HealthcheckCertFile = filepath.Join(dir, "healthcheck.crt")
+	tlsCfg.HealthcheckKeyFile = filepath.Join(dir, "healthcheck.key")
+	if code := checkHealth(addr, tlsCfg); code != 0 {
+		t.Errorf("checkHealth() with the healthcheck certificate = %d, want 0", code)
+	}
+}
+
+// newTestCert writes name.crt and name.key in dir, a CA when parent is nil
+// or a certificate signed by parent.
+func newTestCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, dir, name+".crt", string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	writeFile(t, dir, name+".key", string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})))
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
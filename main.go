@@ -2,8 +2,10 @@ package main // import "github.com/inCaller/prometheus_bot"
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"encoding/xml"
+	"errors"
 	"flag"
 	"fmt"
 	"io"
@@ -13,43 +15,22 @@ import (
 	"net/http"
 	"net/url"
 	"os"
+	"os/signal"
 	"path"
 	"sort"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
 	"html/template"
 
 	"github.com/gin-gonic/gin"
-	"github.com/gin-gonic/gin/binding"
 	"github.com/microcosm-cc/bluemonday"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
-
-	"gopkg.in/yaml.v3"
 )
 
-type Alerts struct {
-	Alerts            []Alert                `json:"alerts"`
-	CommonAnnotations map[string]interface{} `json:"commonAnnotations"`
-	CommonLabels      map[string]interface{} `json:"commonLabels"`
-	ExternalURL       string                 `json:"externalURL"`
-	GroupKey          int                    `json:"groupKey"`
-	GroupLabels       map[string]interface{} `json:"groupLabels"`
-	Receiver          string                 `json:"receiver"`
-	Status            string                 `json:"status"`
-	Version           int                    `json:"version"`
-}
-
-type Alert struct {
-	Annotations  map[string]interface{} `json:"annotations"`
-	EndsAt       string                 `json:"endsAt"`
-	GeneratorURL string                 `json:"generatorURL"`
-	Labels       map[string]interface{} `json:"labels"`
-	StartsAt     string                 `json:"startsAt"`
-	Status       string                 `json:"status"`
-}
-
 type Config struct {
 	TelegramToken       string `yaml:"telegram_token"`
 	TemplatePath        string `yaml:"template_path"`
@@ -60,6 +41,63 @@ type Config struct {
 	SendOnly            bool   `yaml:"send_only"`
 	DisableNotification bool   `yaml:"disable_notification"`
 	LogLevel            string `yaml:"log_level"`
+	// Bearer token for POST /-/reload from other hosts than localhost
+	ReloadToken string `yaml:"reload_token"`
+	// HTTPS for the webhooks
+	TLS TLSConfig `yaml:"tls"`
+	// Permissions of the Unix socket, in octal like "0660"
+	ListenMode string `yaml:"listen_mode"`
+	// Credentials webhooks must carry, chat aliases can have their own
+	WebhookAuth WebhookAuth `yaml:"webhook_auth"`
+	// Larger webhooks are answered 413
+	MaxBodyBytes int64 `yaml:"max_body_bytes"`
+	// Edit previously sent messages when an alert group is updated or resolved
+	EditMessages bool          `yaml:"edit_messages"`
+	EditMaxAge   time.Duration `yaml:"edit_max_age"`
+	// Only post the alerts whose state changed since they were posted in the chat
+	Dedup struct {
+		Policy           string        `yaml:"policy"`
+		ReminderInterval time.Duration `yaml:"reminder_interval"`
+	} `yaml:"dedup"`
+	// Where the bot keeps its state between webhooks
+	Storage struct {
+		Backend string `yaml:"backend"`
+		Path    string `yaml:"path"`
+	} `yaml:"storage"`
+	// Outgoing message queue
+	Queue struct {
+		MaxAge     time.Duration `yaml:"max_age"`
+		MinBackoff time.Duration `yaml:"min_backoff"`
+		MaxBackoff time.Duration `yaml:"max_backoff"`
+		MaxSize    int           `yaml:"max_size"`
+	} `yaml:"queue"`
+	// Limits of messages sent to Telegram
+	RateLimit struct {
+		Global       float64 `yaml:"global"`
+		PerChat      float64 `yaml:"per_chat"`
+		PerChatBurst int     `yaml:"per_chat_burst"`
+	} `yaml:"rate_limit"`
+	// Alertmanager API used to create silences from the chat
+	Alertmanager struct {
+		URL              string          `yaml:"url"`
+		Username         string          `yaml:"username"`
+		Password         string          `yaml:"password"`
+		BearerToken      string          `yaml:"bearer_token"`
+		SilenceDurations []time.Duration `yaml:"silence_durations"`
+		AckButton        bool            `yaml:"ack_button"`
+	} `yaml:"alertmanager"`
+	// Named chats usable instead of chat IDs
+	Chats map[string]ChatConfig `yaml:"chats"`
+	// Who may use commands and buttons, by action
+	Authorization map[string]AuthRule `yaml:"authorization"`
+	// Label based routing for POST /alert
+	Routes []Route `yaml:"routes"`
+	// Named templates, a file or a glob of files named after their base name
+	Templates map[string]string `yaml:"templates"`
+	// One message per alert with the "alert" template, when the template defines it
+	PerAlertMessages bool `yaml:"per_alert_messages"`
+	// Files of the named and route templates, by name or path
+	templateFiles map[string]string
 	// New button configuration
 	DefaultButtonName string `yaml:"default_button_name"`
 	DefaultButtonURL  string `yaml:"default_button_url"`
@@ -170,9 +208,9 @@ func setupLogging(level string) {
  ******************************************************************************/
 func str_Format_MeasureUnit(MeasureUnit string, value string) string {
 	var RetStr string
-	cfg.SplitChart = "|"
+	// Units are always split on |, whatever split_token is
 	MeasureUnit = strings.TrimSpace(MeasureUnit) // Remove space
-	SplittedMUnit := strings.SplitN(MeasureUnit, cfg.SplitChart, 3)
+	SplittedMUnit := strings.SplitN(MeasureUnit, "|", 3)
 
 	Initial := 0
 	// If is declared third part of array, then Measure unit start from just scaled measure unit.
@@ -180,11 +218,7 @@ func str_Format_MeasureUnit(MeasureUnit string, value string) string {
 	if len(SplittedMUnit) > 2 {
 		tmp, err := strconv.ParseInt(SplittedMUnit[2], 10, 8)
 		if err != nil {
-			slog.Error("Could not convert value to int", "error", err)
-			if !*debug {
-				// If is running in production leave daemon live. else here will die with log error.
-				return "" // Break execution and return void string, bot will log somethink
-			}
+			return formatError("str_Format_MeasureUnit", err)
 		}
 		Initial = int(tmp)
 	}
@@ -211,12 +245,13 @@ func str_Format_MeasureUnit(MeasureUnit string, value string) string {
 
 // Scale number for It measure unit
 func str_Format_Byte(in string, initial int) string {
+	const fn = "str_Format_Byte"
 	var str_Size string
 
 	f, err := strconv.ParseFloat(in, 64)
 
 	if err != nil {
-		panic(err)
+		return formatError(fn, err)
 	}
 
 	for j1 := initial; j1 < (Information_Size_MAX + 1); j1++ {
@@ -256,12 +291,13 @@ func str_Format_Byte(in string, initial int) string {
 
 // Format number for fisics measure unit
 func str_Format_Scale(in string, initial int) string {
+	const fn = "str_Format_Scale"
 	var str_Size string
 
 	f, err := strconv.ParseFloat(in, 64)
 
 	if err != nil {
-		panic(err)
+		return formatError(fn, err)
 	}
 
 	for j1 := initial; j1 < (Scale_Size_MAX + 1); j1++ {
@@ -312,29 +348,52 @@ func str_FormatFloat(f string) string {
 	return strconv.FormatFloat(v, 'f', -1, 64)
 }
 
-func str_FormatDate(toformat string) string {
+// str_FormatDate formats a time of the alert, or an RFC 3339 string, in the
+// time_zone with time_outdata.
+func str_FormatDate(toformat any) string {
+	cfg := current().cfg
 
 	// Error handling
 	if cfg.TimeZone == "" {
-		log.Fatal("template_time_zone is not set, if you use template and `str_FormatDate` func is required")
+		return formatError("str_FormatDate", errors.New("time_zone is not set"))
 	}
 
 	if cfg.TimeOutFormat == "" {
-		log.Fatal("template_time_outdata param is not set, if you use template and `str_FormatDate` func is required")
+		return formatError("str_FormatDate", errors.New("time_outdata is not set"))
 	}
 
-	t, err := time.Parse(time.RFC3339Nano, toformat)
+	var t time.Time
+	switch v := toformat.(type) {
+	case time.Time:
+		t = v
+	case string:
+		var err error
+		t, err = time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return formatError("str_FormatDate", err)
+		}
+	default:
+		return formatError("str_FormatDate", fmt.Errorf("%v is not a time", v))
+	}
 
+	loc, err := time.LoadLocation(cfg.TimeZone)
 	if err != nil {
-		fmt.Println(err)
+		return formatError("str_FormatDate", err)
 	}
 
-	loc, _ := time.LoadLocation(cfg.TimeZone)
-
 	return t.In(loc).Format(cfg.TimeOutFormat)
 }
 
-func HasKey(dict map[string]interface{}, key_search string) bool {
+// formatError is what a formatting function returns instead of its result
+// when the value can't be formatted, so one bad label doesn't stop the alert.
+func formatError(fn string, err error) string {
+	slog.Warn("Template function failed", "func", fn, "error", err)
+	formatErrors.WithLabelValues(fn).Inc()
+	formatErrorSeen(fn, err)
+	return fmt.Sprintf("[%s: %v]", fn, err)
+}
+
+func HasKey(dict map[string]string, key_search string) bool {
 	if _, ok := dict[key_search]; ok {
 		return true
 	}
@@ -344,13 +403,13 @@ func HasKey(dict map[string]interface{}, key_search string) bool {
 // Global
 var config_path = flag.String("c", "config.yaml", "Path to a config file")
 var token_path = flag.String("token-from", "", "Path to a file containing telegram_token")
-var listen_addr = flag.String("l", ":9087", "Listen address")
+var listen_addr = flag.String("l", ":9087", "Listen address, or unix:/path/to/socket")
 var template_path = flag.String("t", "", "Path to a template file")
 var debug = flag.Bool("d", false, "Debug template")
+var healthcheck = flag.Bool("healthcheck", false, "Check the health of a running bot listening on -l and exit")
 
-var cfg = Config{}
-var bot *tgbotapi.BotAPI
-var tmpH *template.Template
+var store Store
+var queue = newDeliveryQueue()
 
 // Template additional functions map
 var funcMap = template.FuncMap{
@@ -372,48 +431,87 @@ func telegramBot(bot *tgbotapi.BotAPI) {
 
 	updates := bot.GetUpdatesChan(u)
 
-	introduce := func(update tgbotapi.Update) {
-		msg := tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("Chat id is '%d'", update.Message.Chat.ID))
-		if cfg.DisableNotification {
-			msg.DisableNotification = true
+	for update := range updates {
+		handleUpdate(bot, update)
+	}
+}
+
+// startPolling handles the updates of the bot until it stops receiving them.
+func startPolling(bot *tgbotapi.BotAPI) {
+	registerCommands(bot)
+	go telegramBot(bot)
+}
+
+func introduce(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
+	msg := tgbotapi.NewMessage(update.Message.Chat.ID, fmt.Sprintf("Chat id is '%d'", update.Message.Chat.ID))
+	if current().cfg.DisableNotification {
+		msg.DisableNotification = true
+	}
+	sendMessage(bot, msg)
+}
+
+func handleUpdate(bot *tgbotapi.BotAPI, update tgbotapi.Update) {
+	if query := update.CallbackQuery; query != nil {
+		var chat *tgbotapi.Chat
+		if query.Message != nil {
+			chat = query.Message.Chat
+		}
+		if authorize(callbackAction(query.Data), query.From, chat) {
+			handleCallback(bot, query)
+		} else if _, err := bot.Request(tgbotapi.NewCallback(query.ID, "You are not allowed to do this")); err != nil {
+			slog.Error("Can't answer callback query", "error", err)
 		}
-		bot.Send(msg)
+		return
 	}
 
-	for update := range updates {
-		if update.Message == nil {
-			if *debug {
-				slog.Debug("Unknown message", "update", update)
-			}
-			continue
+	if update.Message == nil {
+		if *debug {
+			slog.Debug("Unknown message", "update", update)
 		}
+		return
+	}
 
-		if len(update.Message.NewChatMembers) > 0 {
-			for _, member := range update.Message.NewChatMembers {
-				if member.UserName == bot.Self.UserName && update.Message.Chat.Type == "group" {
-					introduce(update)
-				}
+	if cmd, ok := commands[update.Message.Command()]; ok {
+		if authorize(cmd.action, update.Message.From, update.Message.Chat) {
+			handleCommand(bot, update.Message, cmd)
+		} else {
+			reply(bot, update.Message, "You are not allowed to do this")
+		}
+		return
+	}
+
+	if len(update.Message.NewChatMembers) > 0 {
+		for _, member := range update.Message.NewChatMembers {
+			if member.UserName == bot.Self.UserName && update.Message.Chat.Type == "group" && authorize(actionAdmin, update.Message.From, update.Message.Chat) {
+				introduce(bot, update)
 			}
-		} else if update.Message != nil && update.Message.Text != "" {
-			introduce(update)
 		}
+	} else if update.Message != nil && update.Message.Text != "" && authorize(actionAdmin, update.Message.From, update.Message.Chat) {
+		introduce(bot, update)
 	}
 }
 
-func loadTemplate(tmplPath string) *template.Template {
-	// let's read template
-	tmpH, err := template.New(path.Base(tmplPath)).Funcs(funcMap).ParseFiles(cfg.TemplatePath)
+// parseTemplate reads a template file.
+func parseTemplate(tmplPath string) (*template.Template, error) {
+	return template.New(path.Base(tmplPath)).Funcs(funcMap).ParseFiles(tmplPath)
+}
+
+// reloadTemplate parses a template again in debug mode, a broken template
+// file keeps the loaded one.
+func reloadTemplate(tmplPath string, loaded *template.Template) *template.Template {
+	tmpl, err := parseTemplate(tmplPath)
 
 	if err != nil {
-		log.Fatalf("Problem reading parsing template file: %v", err)
-	} else {
-		slog.Info("Load template file", "path", tmplPath)
+		slog.Error("Problem parsing template file, keeping the loaded one", "path", tmplPath, "error", err)
+		return loaded
 	}
+	slog.Info("Load template file", "path", tmplPath)
 
-	return tmpH
+	return tmpl
 }
 
 func generateInlineKeyboard(alerts Alerts) *tgbotapi.InlineKeyboardMarkup {
+	cfg := current().cfg
 	var buttons [][]tgbotapi.InlineKeyboardButton
 	var currentRow []tgbotapi.InlineKeyboardButton
 	buttonCount := 0
@@ -446,19 +544,15 @@ func generateInlineKeyboard(alerts Alerts) *tgbotapi.InlineKeyboardMarkup {
 
 			// Check in labels first
 			if val, ok := alert.Labels[btnConfig.Key]; ok {
-				if strVal, ok := val.(string); ok {
-					urlValue = strVal
-					found = true
-				}
+				urlValue = val
+				found = true
 			}
 
 			// Check in annotations if not found in labels
 			if !found {
 				if val, ok := alert.Annotations[btnConfig.Key]; ok {
-					if strVal, ok := val.(string); ok {
-						urlValue = strVal
-						found = true
-					}
+					urlValue = val
+					found = true
 				}
 			}
 
@@ -501,6 +595,11 @@ func generateInlineKeyboard(alerts Alerts) *tgbotapi.InlineKeyboardMarkup {
 		buttons = append(buttons, currentRow)
 	}
 
+	// Silence and Ack buttons go on their own row
+	if actions := actionButtons(alerts); len(actions) > 0 {
+		buttons = append(buttons, actions)
+	}
+
 	if len(buttons) == 0 {
 		return nil
 	}
@@ -516,9 +615,7 @@ func generateButtonText(template string, data ButtonData) string {
 
 	// Add more template variables if needed
 	if alertName, ok := data.Alert.Labels["alertname"]; ok {
-		if alertNameStr, ok := alertName.(string); ok {
-			result = strings.ReplaceAll(result, "{{ .AlertName }}", alertNameStr)
-		}
+		result = strings.ReplaceAll(result, "{{ .AlertName }}", alertName)
 	}
 
 	return result
@@ -553,127 +650,178 @@ func SplitString(s string, n int) []string {
 		}
 	}
 
+	if len(subs) > 1 {
+		messageSplits.Inc()
+	}
 	return subs
 }
 
 func main() {
-	flag.Parse()
-
-	content, err := os.ReadFile(*config_path)
-	if err != nil {
-		log.Fatalf("Problem reading configuration file: %v", err)
+	if len(os.Args) > 1 && os.Args[1] == "render" {
+		os.Exit(runRender(os.Args[2:]))
 	}
-	err = yaml.Unmarshal(content, &cfg)
-	if err != nil {
-		log.Fatalf("Error parsing configuration file: %v", err)
+	if len(os.Args) > 1 && os.Args[1] == "check-config" {
+		os.Exit(runCheckConfig(os.Args[2:]))
 	}
 
-	// Set default log level if not specified
-	if cfg.LogLevel == "" {
-		cfg.LogLevel = "INFO"
-	}
-
-	// Setup logging based on configuration
-	setupLogging(cfg.LogLevel)
+	flag.Parse()
 
-	// Set default button values if not configured
-	if cfg.Buttons.MaxButtonsPerRow == 0 {
-		cfg.Buttons.MaxButtonsPerRow = 3
-	}
-	if cfg.Buttons.MaxTotalButtons == 0 {
-		cfg.Buttons.MaxTotalButtons = 10
+	if *healthcheck {
+		os.Exit(runHealthcheck(*listen_addr))
 	}
 
-	if *template_path != "" {
-		cfg.TemplatePath = *template_path
+	cfg, tmpl, templates, err := loadConfig(true)
+	if err != nil {
+		log.Fatalf("Invalid configuration, check it with check-config:\n%v", err)
 	}
 
-	if *token_path != "" {
-		content, err := os.ReadFile(*token_path)
-		if err != nil {
-			log.Fatalf("Problem reading token file: %v", err)
-		}
-		cfg.TelegramToken = strings.TrimSpace(string(content))
-	}
+	// Setup logging and rate limits based on configuration
+	publish(&snapshot{cfg: cfg, tmpl: tmpl, templates: templates})
+	warnAuthorization(cfg)
 
-	if cfg.SplitMessageBytes == 0 {
-		cfg.SplitMessageBytes = 4000
+	store, err = openStore(cfg.Storage.Backend, cfg.Storage.Path)
+	if err != nil {
+		log.Fatalf("Problem opening storage: %v", err)
 	}
+	warnMigratedChats(cfg)
 
-	if cfg.TemplatePath != "" {
-
-		tmpH = loadTemplate(cfg.TemplatePath)
-
-		if cfg.TimeZone == "" {
-			log.Fatalf("You must define time_zone of your bot")
-		}
-
-	} else {
+	if cfg.TemplatePath == "" {
 		*debug = false
-		tmpH = nil
 	}
+
 	if !(*debug) {
   	gin.SetMode(gin.ReleaseMode)
   }
   gin.DefaultWriter = io.Discard
 
-	for {
-		bot_tmp, err := tgbotapi.NewBotAPI(cfg.TelegramToken)
-		if err == nil {
-			bot = bot_tmp
-			break
-		} else {
-			slog.Error("Error initializing telegram connection", "error", err)
-			time.Sleep(time.Second)
-		}
+	// Queued messages wait for Telegram, webhooks received meanwhile join them
+	if err := queue.Restore(); err != nil {
+		store.Close()
+		log.Fatalf("Problem restoring the message queue: %v", err)
 	}
 
-	if *debug {
-		bot.Debug = true
-	}
+	go reloadOnSIGHUP()
+	go pruneCallbacks()
 
-	slog.Info("Authorised on account", "username", bot.Self.UserName)
+	router := gin.Default()
 
-	if cfg.SendOnly {
-		slog.Info("Works in send_only mode")
-	} else {
-		go telegramBot(bot)
+	router.GET("/health", GET_Health)
+	router.GET("/ready", GET_Ready)
+	router.GET("/metrics", gin.WrapH(promhttp.Handler()))
+	router.POST("/-/reload", POST_Reload)
+	router.GET("/ping/:chatid", authenticateWebhook, GET_Handling)
+	router.GET("/ping/:chatid/:topicid", authenticateWebhook, GET_Handling)
+	for input := range inputAdapters {
+		router.POST("/"+input, limitBody, authenticateWebhook, POST_RoutedHandling)
+		router.POST("/"+input+"/:chatid", limitBody, authenticateWebhook, POST_Handling)
+		router.POST("/"+input+"/:chatid/:topicid", limitBody, authenticateWebhook, POST_Handling)
 	}
 
-	router := gin.Default()
+	mode, _ := socketMode(cfg.ListenMode)
+	ln, err := listen(*listen_addr, mode, cfg.TLS)
+	if err != nil {
+		store.Close()
+		log.Fatalf("Problem opening listener: %v", err)
+	}
+	slog.Info("Listening for webhooks", "address", *listen_addr, "tls", cfg.TLS.enabled())
 
-	router.GET("/ping/:chatid", GET_Handling)
-	router.GET("/ping/:chatid/:topicid", GET_Handling)
-	router.POST("/alert/:chatid", POST_Handling)
-	router.POST("/alert/:chatid/:topicid", POST_Handling)
+	// Health checks and webhooks are answered while Telegram is unreachable
+	go connectTelegram()
 
-	err = router.Run(*listen_addr)
-	if err != nil {
+	server := &http.Server{
+		Handler:           router,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go shutdownOnSignal(server)
+	err = server.Serve(ln)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		store.Close()
 		log.Fatal(err)
 	}
+	// Deliveries in flight are still in the store, they are sent again after a restart
+	if err := store.Close(); err != nil {
+		slog.Error("Problem closing storage", "error", err)
+	}
+}
+
+// shutdownOnSignal stops the server on SIGINT or SIGTERM, letting the
+// requests being handled finish.
+func shutdownOnSignal(server *http.Server) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	<-signals
+	slog.Info("Shutting down")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		slog.Error("Problem shutting down", "error", err)
+	}
+}
+
+// connectTelegram authorises the token, retrying until Telegram accepts it,
+// then publishes the bot and starts handling its updates.
+func connectTelegram() {
+	for {
+		token := current().cfg.TelegramToken
+		bot, err := newBot(token)
+		if err != nil {
+			slog.Error("Error initializing telegram connection", "error", err)
+			time.Sleep(time.Second)
+			continue
+		}
+
+		// A reload may have changed the token meanwhile, and mustn't swap the
+		// bot before it polls
+		publishLock.Lock()
+		s := *current()
+		if s.cfg.TelegramToken != token {
+			publishLock.Unlock()
+			continue
+		}
+		if *debug {
+			bot.Debug = true
+		}
+		s.bot = bot
+		running.Store(&s)
+		slog.Info("Authorised on account", "username", bot.Self.UserName)
+		if s.cfg.SendOnly {
+			slog.Info("Works in send_only mode")
+		} else {
+			startPolling(bot)
+		}
+		publishLock.Unlock()
+
+		markTelegramOK()
+		go checkTelegram()
+		return
+	}
 }
 
 func GET_Handling(c *gin.Context) {
 	slog.Info("Received GET")
-	topicid := getID(c, "topicid")
-	chatid := getID(c, "chatid")
+	chatid, topicid, ok := getChat(c)
+	if !ok {
+		return
+	}
 	slog.Info("Bot test", "chatid", chatid, "topicid", topicid)
 
+	// The test message waits its turn behind the alerts, under the same rate limits
+	d := &Delivery{ChatID: chatid, TopicID: topicid}
 	msgtext := fmt.Sprintf("Some HTTP triggered notification by prometheus bot... %d:%d", chatid, topicid)
-	msg := tgbotapi.NewMessage(chatid, msgtext)
-	msg.ReplyToMessageID = int(topicid)
-	if cfg.DisableNotification {
-		msg.DisableNotification = true
+	if notifier := chatNotifier(c.Param("chatid")); notifier != "" {
+		d = &Delivery{Notifier: notifier}
+		msgtext = "Some HTTP triggered notification by prometheus bot... " + notifier
 	}
-	sendmsg, err := bot.Send(msg)
-	if err == nil {
-		c.String(http.StatusOK, msgtext)
-	} else {
-		c.JSON(http.StatusBadRequest, gin.H{
-			"err":     fmt.Sprint(err),
-			"message": sendmsg,
+	d.Parts = []string{msgtext}
+
+	if err := queue.Enqueue(d); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"err": fmt.Sprint(err),
 		})
+		return
 	}
+	c.String(http.StatusOK, msgtext)
 }
 
 func AlertFormatStandard(alerts Alerts) string {
@@ -712,8 +860,7 @@ func AlertFormatStandard(alerts Alerts) string {
 	alertDetails := make([]string, len(alerts.Alerts))
 	for i, a := range alerts.Alerts {
 		if instance, ok := a.Labels["instance"]; ok {
-			instanceString, _ := instance.(string)
-			alertDetails[i] += strings.Split(instanceString, ":")[0]
+			alertDetails[i] += strings.Split(instance, ":")[0]
 		}
 		if job, ok := a.Labels["job"]; ok {
 			alertDetails[i] += fmt.Sprintf("[%s]", job)
@@ -735,31 +882,99 @@ func AlertFormatStandard(alerts Alerts) string {
 	)
 }
 
-func AlertFormatTemplate(alerts Alerts) string {
-	var bytesBuff bytes.Buffer
-	var err error
+// formatAlerts formats the text with tmpl, or the standard format when it is
+// nil. The text is always set, the error tells the template failed and the
+// standard format was used.
+func formatAlerts(alerts Alerts, tmpl *template.Template) (string, error) {
+	if tmpl == nil {
+		return AlertFormatStandard(alerts), nil
+	}
+	return executeTemplate(tmpl, alerts)
+}
 
-	writer := io.Writer(&bytesBuff)
+// selectTemplate returns the template for alerts, nil for the standard
+// format. name selects a named template or the template file of a routing
+// rule, otherwise a template named after the receiver is used, and the
+// default one after it.
+func selectTemplate(alerts Alerts, name string) *template.Template {
+	s := current()
+	cfg := s.cfg
+	if _, ok := s.templates[alerts.Receiver]; name == "" && ok {
+		name = alerts.Receiver
+	}
+	if name != "" {
+		tmpl := s.templates[name]
+		if *debug {
+			slog.Debug("Reloading Template", "name", name)
+			tmpl = reloadTemplate(cfg.templateFiles[name], tmpl)
+		}
+		return tmpl
+	}
 
+	if cfg.TemplatePath == "" {
+		return nil
+	}
 	if *debug {
 		slog.Debug("Reloading Template")
 		// reload template bacause we in debug mode
-		tmpH = loadTemplate(cfg.TemplatePath)
+		return reloadTemplate(cfg.TemplatePath, s.tmpl)
 	}
+	return s.tmpl
+}
 
-	tmpH.Funcs(funcMap)
-	err = tmpH.Execute(writer, alerts)
+// executeTemplate renders alerts with the "firing" or "resolved" template
+// when tmpl defines it, or with tmpl itself.
+func executeTemplate(tmpl *template.Template, alerts Alerts) (string, error) {
+	name := ""
+	if tmpl != nil && tmpl.Lookup(alerts.Status) != nil {
+		name = alerts.Status
+	}
+	return runTemplate(tmpl, name, alerts, alerts)
+}
+
+// runTemplate executes the template name of tmpl with data, or tmpl itself
+// when name is empty. alerts are sent in the standard format with an error
+// note when the template fails.
+func runTemplate(tmpl *template.Template, name string, data any, alerts Alerts) (string, error) {
+	var bytesBuff bytes.Buffer
+	var err error
+
+	writer := io.Writer(&bytesBuff)
+
+	switch {
+	case tmpl == nil:
+		err = errors.New("template is not loaded")
+	case name != "":
+		err = tmpl.ExecuteTemplate(writer, name, data)
+	default:
+		err = tmpl.Execute(writer, data)
+	}
 
 	if err != nil {
-		log.Fatalf("Problem with template execution: %v", err)
+		templateErrors.Inc()
+		slog.Error("Problem with template execution, using the standard format", "groupKey", alerts.GroupKey, "error", err)
+		return AlertFormatStandard(alerts) + "\n\n⚠️ Template error: " + template.HTMLEscapeString(err.Error()), err
 	}
 
-	return bytesBuff.String()
+	return bytesBuff.String(), nil
 }
 
 // SanitizeMsg check string for HTML validity and
 // strips all HTML tags if it not valid
 func SanitizeMsg(str string) string {
+	if err := validateHTML(str); err != nil {
+		slog.Warn("HTML is not valid, strip all tags to prevent error", "error", err)
+		sanitizeFallbacks.Inc()
+		p := bluemonday.StrictPolicy()
+		return p.Sanitize(str)
+	}
+
+	slog.Debug("HTML is valid, sending it...")
+	return str
+}
+
+// validateHTML returns the first HTML syntax error of str.
+func validateHTML(str string) error {
 	r := strings.NewReader(str)
 	d := xml.NewDecoder(r)
 
@@ -770,44 +985,51 @@ func SanitizeMsg(str string) string {
 	for {
 		_, err := d.Token()
 		if err == io.EOF {
-			slog.Debug("HTML is valid, sending it...")
-			break
+			return nil
 		} else if err != nil {
-			slog.Warn("HTML is not valid, strip all tags to prevent error")
-			p := bluemonday.StrictPolicy()
-			str = p.Sanitize(str)
-			break
+			return err
 		}
 	}
-
-	return str
 }
 
 // get id from relative path
-func getID(c *gin.Context, param string) int64 {
+func getID(c *gin.Context, param string) (int64, error) {
 	// default topicid for messageConfig 0
 	if c.Param(param) == "" && param == "topicid" {
-		return 0
+		return 0, nil
 	}
 	id, err := strconv.ParseInt(c.Param(param), 10, 64)
 	if err != nil {
-		slog.Error("Can't parse id", "param", param, "value", c.Param(param), "error", err)
-		c.JSON(http.StatusServiceUnavailable, gin.H{
-			"err": fmt.Sprint(err),
-		})
+		return 0, fmt.Errorf("%s %q is not a number", param, c.Param(param))
 	}
-	return id
+	return id, nil
 }
 
 func POST_Handling(c *gin.Context) {
-	var msgtext string
-	var alerts Alerts
+	chatid, topicid, ok := getChat(c)
+	if !ok {
+		return
+	}
+	notifier := chatNotifier(c.Param("chatid"))
+	slog.Info("Bot alert post", "chatid", chatid, "topicid", topicid, "notifier", notifier)
 
-	topicid := getID(c, "topicid")
-	chatid := getID(c, "chatid")
-	slog.Info("Bot alert post", "chatid", chatid, "topicid", topicid)
+	tmplName, ok := templateName(c)
+	if !ok {
+		return
+	}
 
-	binding.JSON.Bind(c.Request, &alerts)
+	alerts, ok := readAlerts(c)
+	if !ok {
+		return
+	}
+	countWebhook(c, alerts)
+	forgetCallbacks(alerts)
+
+	alerts, ok = changedAlerts(chatid, topicid, notifier, alerts)
+	if !ok {
+		c.String(http.StatusOK, "no alert changed, nothing sent.")
+		return
+	}
 
 	s, err := json.Marshal(alerts)
 	if err != nil {
@@ -817,53 +1039,189 @@ func POST_Handling(c *gin.Context) {
 
 	slog.Debug("Alert JSON", "json", string(s))
 
-	// Decide how format Text
-	if cfg.TemplatePath == "" {
-		msgtext = AlertFormatStandard(alerts)
-	} else {
-		msgtext = AlertFormatTemplate(alerts)
+	var deliveries []*Delivery
+	for _, message := range renderMessages(alerts, tmplName) {
+		deliveries = append(deliveries, newDelivery(chatid, topicid, notifier, message))
 	}
+	if err := queue.Enqueue(deliveries...); err != nil {
+		slog.Error("Error queueing message", "error", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"err": fmt.Sprint(err),
+		})
+		return
+	}
+	c.String(http.StatusOK, "telegram msg queued.")
+}
 
-	// Generate inline keyboard
-	inlineKeyboard := generateInlineKeyboard(alerts)
+// deliverAlerts sends the message parts of an alert group to the chat. When
+// edit_messages is enabled and the group was already posted, the previous
+// messages are edited in place instead, falling back to new messages when
+// they are too old or can no longer be edited. Delivered parts are kept in
+// d.MessageIDs, so a retry continues with the first part that failed.
+func deliverAlerts(bot *tgbotapi.BotAPI, d *Delivery) error {
+	var prev MessageRecord
+	var found bool
+
+	cfg := current().cfg
+	// Queued before the group was migrated to a supergroup, it follows it
+	d.ChatID = migratedChatID(d.ChatID)
+	chatid, topicid, alerts := d.ChatID, d.TopicID, d.Alerts
+
+	key := messageKey(chatid, topicid, alerts.GroupKey)
+	if cfg.EditMessages && alerts.GroupKey != "" {
+		var err error
+		found, err = store.Get(bucketMessages, key, &prev)
+		if err != nil {
+			slog.Error("Can't read message state", "key", key, "error", err)
+		}
+		if found && time.Since(prev.SentAt) > cfg.EditMaxAge {
+			slog.Debug("Previous message is too old to edit", "groupKey", alerts.GroupKey, "sentAt", prev.SentAt)
+			found = false
+		}
+	}
+
+	rec := MessageRecord{
+		ChatID:   chatid,
+		TopicID:  topicid,
+		GroupKey: alerts.GroupKey,
+		SentAt:   time.Now(),
+	}
+	if found {
+		rec.SentAt = prev.SentAt
+	}
 
-	for _, subString := range SplitString(msgtext, cfg.SplitMessageBytes) {
+	// Previous messages replaced by new ones, they would show stale alerts
+	var stale []int
+	for i := len(d.MessageIDs); i < len(d.Parts); i++ {
+		subString := d.Parts[i]
 
 		sanitizedString := SanitizeMsg(subString)
 
+		// Print in Log result message
+		slog.Debug("Final message", "message", subString)
+
+		if found && i < len(prev.MessageIDs) {
+			edit := tgbotapi.NewEditMessageText(chatid, prev.MessageIDs[i], sanitizedString)
+			edit.ParseMode = tgbotapi.ModeHTML
+			edit.DisableWebPagePreview = true
+			edit.ReplyMarkup = d.Keyboard
+
+			waitToSend(chatid)
+			_, err := bot.Send(edit)
+			countSend(chatid, err)
+			if err == nil || isNotModified(err) {
+				d.MessageIDs = append(d.MessageIDs, prev.MessageIDs[i])
+				continue
+			}
+			if retryAfter(err) > 0 {
+				return err
+			}
+			slog.Warn("Can't edit message, sending a new one", "chatid", chatid, "messageid", prev.MessageIDs[i], "error", err)
+			stale = append(stale, prev.MessageIDs[i])
+		}
+
 		msg := tgbotapi.NewMessage(chatid, sanitizedString)
 		msg.ParseMode = tgbotapi.ModeHTML
 		msg.ReplyToMessageID = int(topicid)
 
 		// Add inline keyboard if we have buttons
-		if inlineKeyboard != nil {
-			msg.ReplyMarkup = inlineKeyboard
+		if d.Keyboard != nil {
+			msg.ReplyMarkup = d.Keyboard
 		}
 
-		// Print in Log result message
-		slog.Debug("Final message", "message", subString)
-
 		msg.DisableWebPagePreview = true
 		if cfg.DisableNotification {
 			msg.DisableNotification = true
 		}
 
-		sendmsg, err := bot.Send(msg)
-		if err == nil {
-			c.String(http.StatusOK, "telegram msg sent.")
+		sendmsg, err := sendMessage(bot, msg)
+		if err != nil {
+			return err
+		}
+		if sendmsg.Chat != nil && sendmsg.Chat.ID != chatid {
+			// Migrated while sending, the old group can't be edited anymore
+			if err := store.Delete(bucketMessages, key); err != nil {
+				slog.Error("Can't remove message state", "key", key, "error", err)
+			}
+			chatid, d.ChatID = sendmsg.Chat.ID, sendmsg.Chat.ID
+			key = messageKey(chatid, topicid, alerts.GroupKey)
+			rec.ChatID = chatid
+			found, stale = false, nil
+		}
+		d.MessageIDs = append(d.MessageIDs, sendmsg.MessageID)
+	}
+	rec.MessageIDs = d.MessageIDs
+
+	// The group got shorter than its previous messages
+	if found && len(prev.MessageIDs) > len(d.Parts) {
+		stale = append(stale, prev.MessageIDs[len(d.Parts):]...)
+	}
+	removeMessages(bot, chatid, stale)
+
+	if !cfg.EditMessages || alerts.GroupKey == "" {
+		return nil
+	}
+
+	// A resolved group is done, the next firing starts a new thread of messages
+	if alerts.Status == "resolved" {
+		return store.Delete(bucketMessages, key)
+	}
+	return store.Put(bucketMessages, key, rec)
+}
+
+// recordAlerts remembers the state of every alert delivered to a chat,
+// resolved alerts are forgotten.
+func recordAlerts(d *Delivery) {
+	now := time.Now()
+	chatid, topicid, alerts := d.ChatID, d.TopicID, d.Alerts
+	for _, alert := range alerts.Alerts {
+		fingerprint := alert.fingerprint()
+		key := alertKey(d.chat(), topicid, fingerprint)
+
+		var err error
+		if alert.Status == "resolved" {
+			err = store.Delete(bucketAlerts, key)
 		} else {
-			slog.Error("Error sending message", "error", err)
-			c.JSON(http.StatusServiceUnavailable, gin.H{
-				"err":     fmt.Sprint(err),
-				"message": sendmsg,
-				"srcmsg":  fmt.Sprint(msgtext),
+			err = store.Put(bucketAlerts, key, AlertRecord{
+				Fingerprint: fingerprint,
+				ChatID:      chatid,
+				TopicID:     topicid,
+				Labels:      alert.Labels,
+				Status:      alert.Status,
+				StartsAt:    alert.StartsAt,
+				LastSentAt:  now,
 			})
-			msg := tgbotapi.NewMessage(chatid, "Error sending message, checkout logs")
-			if cfg.DisableNotification {
-				msg.DisableNotification = true
-			}
-			bot.Send(msg)
+		}
+		if err != nil {
+			slog.Error("Can't record alert state", "fingerprint", fingerprint, "error", err)
 		}
 	}
+}
 
-}
\ No newline at end of file
+// removeMessages deletes the outdated messages of an alert group, or blanks
+// them when Telegram refuses to delete them, as it does for messages older
+// than 48 hours.
+func removeMessages(bot *tgbotapi.BotAPI, chatid int64, ids []int) {
+	for _, id := range ids {
+		waitToSend(chatid)
+		_, err := bot.Request(tgbotapi.NewDeleteMessage(chatid, id))
+		if err == nil {
+			continue
+		}
+		slog.Debug("Can't delete outdated message, blanking it", "chatid", chatid, "messageid", id, "error", err)
+
+		// Without reply markup the buttons go away too
+		waitToSend(chatid)
+		_, err = bot.Send(tgbotapi.NewEditMessageText(chatid, id, "…"))
+		if err != nil && !isNotModified(err) {
+			slog.Warn("Can't remove outdated message", "chatid", chatid, "messageid", id, "error", err)
+		}
+	}
+}
+
+// isNotModified reports whether Telegram refused an edit because the text
+// did not change, which for us means the message is already up to date.
+func isNotModified(err error) bool {
+	var tgErr *tgbotapi.Error
+	return errors.As(err, &tgErr) && strings.Contains(tgErr.Message, "message is not modified")
+}
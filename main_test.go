@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMain(m *testing.M) {
+	// Queue workers outlive the tests that start them, they share one store
+	store = newMemoryStore()
+	useConfig(&Config{})
+	os.Exit(m.Run())
+}
+
+// useConfig makes cfg, with the defaults filled in, the running
+// configuration. Tests aren't rate limited unless they set a limit.
+func useConfig(cfg *Config) *Config {
+	if cfg.RateLimit.PerChatBurst == 0 {
+		cfg.RateLimit.PerChatBurst = 1000
+	}
+	setDefaults(cfg)
+	running.Store(&snapshot{cfg: cfg})
+	setupRateLimits(cfg)
+	return cfg
+}
+
+// fakeTelegram answers the Bot API methods the bot uses and records the
+// calls it gets.
+type fakeTelegram struct {
+	mu     sync.Mutex
+	calls  []telegramCall
+	nextID int
+	// Methods answering with an error description
+	fail map[string]string
+	// Groups migrated to a supergroup, by chat ID
+	migrated map[string]int64
+}
+
+type telegramCall struct {
+	Method string
+	Params url.Values
+}
+
+func newFakeTelegram(t *testing.T) (*tgbotapi.BotAPI, *fakeTelegram) {
+	t.Helper()
+	fake := &fakeTelegram{nextID: 100, fail: map[string]string{}, migrated: map[string]int64{}}
+	server := httptest.NewServer(fake)
+	t.Cleanup(server.Close)
+
+	bot, err := tgbotapi.NewBotAPIWithClient("token", server.URL+"/bot%s/%s", server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.mu.Lock()
+	fake.calls = nil
+	fake.mu.Unlock()
+	return bot, fake
+}
+
+func (f *fakeTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r.ParseForm()
+	method := path.Base(r.URL.Path)
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, telegramCall{method, r.Form})
+
+	if description, ok := f.fail[method]; ok {
+		json.NewEncoder(w).Encode(map[string]any{"ok": false, "error_code": 400, "description": description})
+		return
+	}
+	if to, ok := f.migrated[r.Form.Get("chat_id")]; ok {
+		json.NewEncoder(w).Encode(map[string]any{
+			"ok": false, "error_code": 400, "description": "Bad Request: group chat was upgraded to a supergroup chat",
+			"parameters": map[string]any{"migrate_to_chat_id": to},
+		})
+		return
+	}
+	var result any = true
+	switch method {
+	case "getMe":
+		result = map[string]any{"id": 1, "is_bot": true, "username": "test_bot"}
+	case "sendMessage":
+		f.nextID++
+		chatid, _ := strconv.ParseInt(r.Form.Get("chat_id"), 10, 64)
+		result = map[string]any{"message_id": f.nextID, "chat": map[string]any{"id": chatid}}
+	case "editMessageText":
+		id, _ := strconv.Atoi(r.Form.Get("message_id"))
+		result = map[string]any{"message_id": id}
+	}
+	json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": result})
+}
+
+// Calls returns the methods called, with the message ID or the text they got.
+func (f *fakeTelegram) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var calls []string
+	for _, c := range f.calls {
+		arg := c.Params.Get("message_id")
+		if arg == "" {
+			arg = c.Params.Get("text")
+		}
+		calls = append(calls, c.Method+" "+arg)
+	}
+	return calls
+}
+
+func TestDeliverAlertsEditsGroup(t *testing.T) {
+	useConfig(&Config{EditMessages: true})
+	bot, fake := newFakeTelegram(t)
+	alerts := Alerts{GroupKey: "{}:{alertname=\"shrinking\"}", Status: "firing"}
+
+	first := &Delivery{ChatID: 42, Alerts: alerts, Parts: []string{"one", "two", "three"}}
+	if err := deliverAlerts(bot, first); err != nil {
+		t.Fatal(err)
+	}
+	if got := len(fake.Calls()); got != 3 {
+		t.Fatalf("first delivery made %d calls, want 3", got)
+	}
+	fake.mu.Lock()
+	fake.calls = nil
+	fake.mu.Unlock()
+
+	// The group shrinks to one message, the two others are removed
+	fake.fail["deleteMessage"] = "Bad Request: message can't be deleted"
+	second := &Delivery{ChatID: 42, Alerts: alerts, Parts: []string{"only"}}
+	if err := deliverAlerts(bot, second); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"editMessageText 101",
+		"deleteMessage 102",
+		"editMessageText 102",
+		"deleteMessage 103",
+		"editMessageText 103",
+	}
+	if got := fake.Calls(); !reflect.DeepEqual(got, want) {
+		t.Errorf("second delivery calls = %q, want %q", got, want)
+	}
+
+	var rec MessageRecord
+	if _, err := store.Get(bucketMessages, messageKey(42, 0, alerts.GroupKey), &rec); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(rec.MessageIDs, []int{101}) {
+		t.Errorf("recorded messages = %v, want [101]", rec.MessageIDs)
+	}
+}
+
+func TestDeliverAlertsFollowsMigration(t *testing.T) {
+	useConfig(&Config{EditMessages: true})
+	bot, fake := newFakeTelegram(t)
+	fake.migrated["-5"] = -1005
+	alerts := Alerts{GroupKey: "{}:{alertname=\"migrating\"}", Status: "firing"}
+
+	first := &Delivery{ChatID: -5, Alerts: alerts, Parts: []string{"one", "two"}}
+	if err := deliverAlerts(bot, first); err != nil {
+		t.Fatal(err)
+	}
+	if first.ChatID != -1005 {
+		t.Errorf("delivery chat = %d after the migration, want -1005", first.ChatID)
+	}
+	if got := migratedChatID(-5); got != -1005 {
+		t.Errorf("migratedChatID(-5) = %d, want -1005", got)
+	}
+
+	// Queued for the old group, the update edits the messages of the supergroup
+	fake.mu.Lock()
+	fake.calls = nil
+	fake.mu.Unlock()
+	second := &Delivery{ChatID: -5, Alerts: alerts, Parts: []string{"one", "two"}}
+	if err := deliverAlerts(bot, second); err != nil {
+		t.Fatal(err)
+	}
+	for _, call := range fake.calls {
+		if call.Method != "editMessageText" || call.Params.Get("chat_id") != "-1005" {
+			t.Errorf("update called %s in chat %s, want editMessageText in -1005", call.Method, call.Params.Get("chat_id"))
+		}
+	}
+	if len(fake.calls) != 2 {
+		t.Errorf("update made %d calls, want 2", len(fake.calls))
+	}
+}
+
+// writeFile writes a file of the test, returning its path.
+func writeFile(t *testing.T, dir string, name string, content string) string {
+	t.Helper()
+	file := filepath.Join(dir, name)
+	if err := os.WriteFile(file, []byte(content), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestFormatFunctions(t *testing.T) {
+	useConfig(&Config{})
+
+	tests := []struct {
+		name string
+		got  func() string
+		want string
+	}{
+		{name: "byte", got: func() string { return str_Format_Byte("2048", Kb) }, want: "2.00 Mb"},
+		{name: "byte not a number", got: func() string { return str_Format_Byte("lots", Kb) }, want: "[str_Format_Byte: "},
+		{name: "scale", got: func() string { return str_Format_Scale("1500", K) }, want: "1.50 M"},
+		{name: "scale not a number", got: func() string { return str_Format_Scale("", K) }, want: "[str_Format_Scale: "},
+		{name: "measure unit", got: func() string { return str_Format_MeasureUnit("kb|B|1", "2048") }, want: "2.00 GbB"},
+		{name: "measure unit bad initial", got: func() string { return str_Format_MeasureUnit("kb|B|x", "1") }, want: "[str_Format_MeasureUnit: "},
+		{name: "measure unit bad value", got: func() string { return str_Format_MeasureUnit("s|W", "n/a") }, want: "[str_Format_Scale: "},
+		{name: "date without time_zone", got: func() string { return str_FormatDate("2024-01-01T00:00:00Z") }, want: "[str_FormatDate: time_zone is not set]"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			func() {
+				defer func() {
+					if r := recover(); r != nil {
+						t.Fatalf("panicked: %v", r)
+					}
+				}()
+				got = tt.got()
+			}()
+			if !strings.HasPrefix(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFormatDate(t *testing.T) {
+	useConfig(&Config{TimeZone: "Europe/Paris", TimeOutFormat: "2006-01-02 15:04"})
+	if got := str_FormatDate("2024-01-01T00:00:00Z"); got != "2024-01-01 01:00" {
+		t.Errorf("str_FormatDate() = %q, want 2024-01-01 01:00", got)
+	}
+	if got := str_FormatDate(42); !strings.HasPrefix(got, "[str_FormatDate: ") {
+		t.Errorf("str_FormatDate(42) = %q, want the error", got)
+	}
+}
+
+func TestRunTemplateFallback(t *testing.T) {
+	useConfig(&Config{})
+	alerts := Alerts{
+		Status: "firing",
+		Alerts: []Alert{{Status: "firing", Labels: map[string]string{"alertname": "Fallback"}, StartsAt: time.Now()}},
+	}
+	broken := template.Must(template.New("broken").Parse(`{{ template "missing" . }}`))
+
+	for name, tmpl := range map[string]*template.Template{"failing": broken, "not loaded": nil} {
+		t.Run(name, func(t *testing.T) {
+			before := testutil.ToFloat64(templateErrors)
+			got, err := runTemplate(tmpl, "", alerts, alerts)
+			if err == nil {
+				t.Fatal("runTemplate() error = nil")
+			}
+			if !strings.HasPrefix(got, AlertFormatStandard(alerts)) || !strings.Contains(got, "⚠️ Template error: ") {
+				t.Errorf("runTemplate() = %q, want the standard format with the error", got)
+			}
+			if grown := testutil.ToFloat64(templateErrors) - before; grown != 1 {
+				t.Errorf("template_errors_total grew by %v, want 1", grown)
+			}
+		})
+	}
+}
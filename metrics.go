@@ -0,0 +1,164 @@
+package main
+
+import (
+	"net/http"
+	"path"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Metrics about the bot itself, served on /metrics
+var (
+	webhooksReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_bot_webhooks_received_total",
+		Help: "Webhooks received, by chat alias (chat_id for chat IDs, routes for the routing rules) and alert group status.",
+	}, []string{"chat", "status"})
+
+	messagesSent = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_bot_messages_sent_total",
+		Help: "Messages sent or edited, by chat alias (chat_id for chat IDs).",
+	}, []string{"chat"})
+
+	messagesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_bot_messages_failed_total",
+		Help: "Messages that failed to be sent or edited, by chat alias (chat_id for chat IDs).",
+	}, []string{"chat"})
+
+	telegramLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "prometheus_bot_telegram_request_duration_seconds",
+		Help:    "Duration of Telegram Bot API requests, by method.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"method"})
+
+	templateErrors = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_bot_template_errors_total",
+		Help: "Template executions that failed and fell back to the standard format.",
+	})
+
+	formatErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_bot_format_errors_total",
+		Help: "Values template functions could not format, by function.",
+	}, []string{"func"})
+
+	webhookAuthFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_bot_webhook_auth_failures_total",
+		Help: "Webhooks rejected because of missing or wrong credentials or signature, by reason.",
+	}, []string{"reason"})
+
+	webhooksRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "prometheus_bot_webhooks_rejected_total",
+		Help: "Webhooks rejected because they are too large or not valid, by reason.",
+	}, []string{"reason"})
+
+	alertsDeduplicated = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_bot_alerts_deduplicated_total",
+		Help: "Alerts not posted again because their state didn't change.",
+	})
+
+	sanitizeFallbacks = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_bot_sanitize_fallbacks_total",
+		Help: "Messages with invalid HTML sent with all tags stripped.",
+	})
+
+	messageSplits = prometheus.NewCounter(prometheus.CounterOpts{
+		Name: "prometheus_bot_message_splits_total",
+		Help: "Messages too long for Telegram that were split in parts.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		webhooksReceived,
+		webhookAuthFailures,
+		webhooksRejected,
+		alertsDeduplicated,
+		messagesSent,
+		messagesFailed,
+		telegramLatency,
+		templateErrors,
+		formatErrors,
+		sanitizeFallbacks,
+		messageSplits,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name: "prometheus_bot_queue_depth",
+			Help: "Messages waiting in the delivery queue.",
+		}, func() float64 {
+			return float64(queue.Depth())
+		}),
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Name: "prometheus_bot_queue_dropped_total",
+			Help: "Messages dropped from the delivery queue because they were too old or refused by Telegram.",
+		}, func() float64 {
+			return float64(queue.Dropped())
+		}),
+	)
+}
+
+// countWebhook counts a webhook by the chat of its path and its status. The
+// labels only take values from the configuration, not from the payload or
+// any chat ID, so a sender can't grow the number of series.
+func countWebhook(c *gin.Context, alerts Alerts) {
+	cfg := current().cfg
+	chat := c.Param("chatid")
+	if chat == "" {
+		chat = "routes"
+	} else if _, ok := cfg.Chats[chat]; !ok {
+		chat = "chat_id"
+	}
+	status := alerts.Status
+	if status != "firing" && status != "resolved" {
+		status = "unknown"
+	}
+	webhooksReceived.WithLabelValues(chat, status).Inc()
+}
+
+// countSend counts a message sent or failed in a chat, an edit that changed
+// nothing is not a failure.
+func countSend(chatid int64, err error) {
+	chat := chatLabel(chatid)
+	if err != nil && !isNotModified(err) {
+		messagesFailed.WithLabelValues(chat).Inc()
+	} else {
+		messagesSent.WithLabelValues(chat).Inc()
+	}
+}
+
+// chatLabel returns the chat label of a Telegram chat, like countWebhook: its
+// alias, the first by name when it has several, or chat_id.
+func chatLabel(chatid int64) string {
+	label := ""
+	for name, alias := range current().cfg.Chats {
+		if alias.Notifier == nil && migratedChatID(alias.ID) == chatid && (label == "" || name < label) {
+			label = name
+		}
+	}
+	if label == "" {
+		return "chat_id"
+	}
+	return label
+}
+
+// countNotify counts a message sent or failed by the notifier of a chat
+// alias, the alias is the chat.
+func countNotify(alias string, err error) {
+	if err != nil {
+		messagesFailed.WithLabelValues(alias).Inc()
+	} else {
+		messagesSent.WithLabelValues(alias).Inc()
+	}
+}
+
+// instrumentedClient measures the latency of Telegram Bot API requests.
+type instrumentedClient struct {
+	client *http.Client
+}
+
+func (c instrumentedClient) Do(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := c.client.Do(req)
+	// The last element of the path is the API method, the token comes before it
+	telegramLatency.WithLabelValues(path.Base(req.URL.Path)).Observe(time.Since(start).Seconds())
+	return resp, err
+}
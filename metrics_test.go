@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestCountWebhook(t *testing.T) {
+	useConfig(&Config{Chats: map[string]ChatConfig{"oncall": {ID: -100}}})
+
+	tests := []struct {
+		chat, status         string
+		wantChat, wantStatus string
+	}{
+		{"oncall", "firing", "oncall", "firing"},
+		{"-100123", "resolved", "chat_id", "resolved"},
+		{"", "firing", "routes", "firing"},
+		{"oncall", "<script>", "oncall", "unknown"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.chat+"/"+tt.status, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			if tt.chat != "" {
+				c.Params = gin.Params{{Key: "chatid", Value: tt.chat}}
+			}
+			counter := webhooksReceived.WithLabelValues(tt.wantChat, tt.wantStatus)
+			before := testutil.ToFloat64(counter)
+			countWebhook(c, Alerts{Receiver: "anything " + tt.status, Status: tt.status})
+			if got := testutil.ToFloat64(counter) - before; got != 1 {
+				t.Errorf("webhooks_received{chat=%q, status=%q} grew by %v, want 1", tt.wantChat, tt.wantStatus, got)
+			}
+		})
+	}
+}
+
+func TestCountSend(t *testing.T) {
+	useConfig(&Config{Chats: map[string]ChatConfig{
+		"team-b": {ID: -77},
+		"team-a": {ID: -77, Topic: 3},
+		"slack":  {ID: -78, Notifier: &NotifierConfig{Type: "slack"}},
+	}})
+
+	tests := []struct {
+		name   string
+		chatid int64
+		err    error
+		chat   string
+		sent   bool
+	}{
+		{name: "alias", chatid: -77, chat: "team-a", sent: true},
+		{name: "chat ID", chatid: -123456, chat: "chat_id", sent: true},
+		{name: "notifier alias is no Telegram chat", chatid: -78, chat: "chat_id", sent: true},
+		{name: "failure", chatid: -77, err: &tgbotapi.Error{Code: 403, Message: "Forbidden"}, chat: "team-a"},
+		{name: "not modified", chatid: -77, err: &tgbotapi.Error{Code: 400, Message: "Bad Request: message is not modified"}, chat: "team-a", sent: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sent, failed := messagesSent.WithLabelValues(tt.chat), messagesFailed.WithLabelValues(tt.chat)
+			sentBefore, failedBefore := testutil.ToFloat64(sent), testutil.ToFloat64(failed)
+			countSend(tt.chatid, tt.err)
+			gotSent, gotFailed := testutil.ToFloat64(sent)-sentBefore, testutil.ToFloat64(failed)-failedBefore
+			if want := map[bool]float64{true: 1}; gotSent != want[tt.sent] || gotFailed != want[!tt.sent] {
+				t.Errorf("chat %q counted sent %v, failed %v, want sent %v", tt.chat, gotSent, gotFailed, tt.sent)
+			}
+		})
+	}
+}
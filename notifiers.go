@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+	"github.com/microcosm-cc/bluemonday"
+)
+
+// Notifier sends the messages of a delivery to a chat system. Deliveries
+// that fail are retried by the queue.
+type Notifier interface {
+	Notify(d *Delivery) error
+}
+
+// NotifierConfig makes a chat alias send to another chat system than
+// Telegram.
+type NotifierConfig struct {
+	// webhook, slack, mattermost or matrix
+	Type string `yaml:"type"`
+	// URL of the webhook, or the incoming webhook of Slack or Mattermost
+	URL string `yaml:"url"`
+	// Extra headers of the webhook requests, like an API key
+	Headers map[string]string `yaml:"headers"`
+	// Slack and Mattermost, the defaults of the incoming webhook otherwise
+	Channel  string `yaml:"channel"`
+	Username string `yaml:"username"`
+	IconURL  string `yaml:"icon_url"`
+	// Matrix
+	Homeserver  string `yaml:"homeserver"`
+	RoomID      string `yaml:"room_id"`
+	AccessToken string `yaml:"access_token"`
+}
+
+// errNotConnected is the error of Telegram deliveries before the bot is
+// authorised, they are retried.
+var errNotConnected = errors.New("telegram is not connected yet")
+
+// Client of the notifiers, Telegram has its own
+var notifierClient = &http.Client{Timeout: 30 * time.Second}
+
+// notifierFor returns the notifier of a delivery, Telegram unless the
+// delivery is for a chat alias with a notifier.
+func notifierFor(name string) (Notifier, error) {
+	s := current()
+	if name == "" {
+		if s.bot == nil {
+			return nil, errNotConnected
+		}
+		return telegramNotifier{s.bot}, nil
+	}
+	alias, ok := s.cfg.Chats[name]
+	if !ok || alias.Notifier == nil {
+		return nil, fmt.Errorf("chat alias %q has no notifier", name)
+	}
+
+	n := alias.Notifier
+	switch n.Type {
+	case "webhook":
+		return webhookNotifier{name, n}, nil
+	case "slack":
+		return slackNotifier{name, n, slackMarkup}, nil
+	case "mattermost":
+		return slackNotifier{name, n, markdownMarkup}, nil
+	case "matrix":
+		return matrixNotifier{name, n}, nil
+	}
+	return nil, fmt.Errorf("chat alias %q: unknown notifier type %q", name, n.Type)
+}
+
+// validateNotifier returns the problems of the notifier of a chat alias.
+func validateNotifier(n *NotifierConfig) []string {
+	var problems []string
+	switch n.Type {
+	case "webhook", "slack", "mattermost":
+		if !isValidURL(n.URL) {
+			problems = append(problems, fmt.Sprintf("url %q is not an http or https URL", n.URL))
+		}
+	case "matrix":
+		if !isValidURL(n.Homeserver) {
+			problems = append(problems, fmt.Sprintf("homeserver %q is not an http or https URL", n.Homeserver))
+		}
+		if n.RoomID == "" || n.AccessToken == "" {
+			problems = append(problems, "room_id and access_token are required")
+		}
+	default:
+		problems = append(problems, fmt.Sprintf("unknown type %q, use webhook, slack, mattermost or matrix", n.Type))
+	}
+	return problems
+}
+
+// telegramNotifier sends to Telegram with its bot.
+type telegramNotifier struct {
+	bot *tgbotapi.BotAPI
+}
+
+func (n telegramNotifier) Notify(d *Delivery) error {
+	return deliverAlerts(n.bot, d)
+}
+
+// webhookNotifier posts the message and the alerts as JSON.
+type webhookNotifier struct {
+	name   string
+	config *NotifierConfig
+}
+
+// webhookMessage is the body of the requests of the webhook notifier.
+type webhookMessage struct {
+	Chat string `json:"chat"`
+	// The message in plain text, and as rendered by the template
+	Text   string `json:"text"`
+	HTML   string `json:"html"`
+	Alerts Alerts `json:"alerts"`
+}
+
+func (n webhookNotifier) Notify(d *Delivery) error {
+	text := strings.Join(d.Parts, "")
+	return sendJSON(n.name, http.MethodPost, n.config.URL, n.config.Headers, webhookMessage{
+		Chat:   n.name,
+		Text:   convertHTML(text, plainMarkup),
+		HTML:   text,
+		Alerts: d.Alerts,
+	})
+}
+
+// slackNotifier posts to a Slack or Mattermost incoming webhook, they take
+// the same payload with their own markup.
+type slackNotifier struct {
+	name   string
+	config *NotifierConfig
+	markup markup
+}
+
+type slackMessage struct {
+	Text     string `json:"text"`
+	Channel  string `json:"channel,omitempty"`
+	Username string `json:"username,omitempty"`
+	IconURL  string `json:"icon_url,omitempty"`
+}
+
+func (n slackNotifier) Notify(d *Delivery) error {
+	return sendJSON(n.name, http.MethodPost, n.config.URL, nil, slackMessage{
+		Text:     convertHTML(strings.Join(d.Parts, ""), n.markup),
+		Channel:  n.config.Channel,
+		Username: n.config.Username,
+		IconURL:  n.config.IconURL,
+	})
+}
+
+// matrixNotifier sends a message event to a Matrix room with the
+// client-server API.
+type matrixNotifier struct {
+	name   string
+	config *NotifierConfig
+}
+
+type matrixMessage struct {
+	MsgType       string `json:"msgtype"`
+	Body          string `json:"body"`
+	Format        string `json:"format"`
+	FormattedBody string `json:"formatted_body"`
+}
+
+func (n matrixNotifier) Notify(d *Delivery) error {
+	text := strings.Join(d.Parts, "")
+	// The transaction ID of the delivery makes retries idempotent
+	endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+		strings.TrimRight(n.config.Homeserver, "/"), url.PathEscape(n.config.RoomID), url.PathEscape(d.ID))
+	return sendJSON(n.name, http.MethodPut, endpoint, map[string]string{"Authorization": "Bearer " + n.config.AccessToken}, matrixMessage{
+		MsgType:       "m.text",
+		Body:          convertHTML(text, plainMarkup),
+		Format:        "org.matrix.custom.html",
+		FormattedBody: convertHTML(text, matrixMarkup),
+	})
+}
+
+// httpError is a request a notifier refused.
+type httpError struct {
+	Code       int
+	Body       string
+	RetryAfter time.Duration
+}
+
+func (e *httpError) Error() string {
+	return fmt.Sprintf("HTTP %d: %s", e.Code, e.Body)
+}
+
+// sendJSON sends body as JSON and returns an httpError for responses other
+// than 2xx.
+func sendJSON(name string, method string, endpoint string, headers map[string]string, body any) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := notifierClient.Do(req)
+	if err == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode > 299 {
+			text, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+			seconds, _ := strconv.Atoi(resp.Header.Get("Retry-After"))
+			err = &httpError{resp.StatusCode, strings.TrimSpace(string(text)), time.Duration(seconds) * time.Second}
+		}
+	}
+	countNotify(name, err)
+	return err
+}
+
+// markup is how a chat system formats the tags of Telegram HTML messages.
+type markup struct {
+	// Opening and closing text of tags, tags that are not listed keep only their text
+	tags   map[string][2]string
+	link   func(href string, text string) string
+	escape func(text string) string
+	// In <pre>, where code tags are not repeated
+	preEscape func(text string) string
+}
+
+var (
+	plainMarkup = markup{
+		link: func(href, text string) string {
+			if href == "" || href == text {
+				return text
+			}
+			return text + " (" + href + ")"
+		},
+	}
+	slackMarkup = markup{
+		tags: map[string][2]string{
+			"b": {"*", "*"}, "strong": {"*", "*"}, "i": {"_", "_"}, "em": {"_", "_"},
+			"s": {"~", "~"}, "strike": {"~", "~"}, "del": {"~", "~"},
+			"code": {"`", "`"}, "pre": {"```\n", "\n```"},
+		},
+		link: func(href, text string) string {
+			return "<" + href + "|" + text + ">"
+		},
+		escape: strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;").Replace,
+	}
+	markdownMarkup = markup{
+		tags: map[string][2]string{
+			"b": {"**", "**"}, "strong": {"**", "**"}, "i": {"_", "_"}, "em": {"_", "_"},
+			"s": {"~~", "~~"}, "strike": {"~~", "~~"}, "del": {"~~", "~~"},
+			"code": {"`", "`"}, "pre": {"```\n", "\n```"},
+		},
+		link: func(href, text string) string {
+			return "[" + text + "](" + href + ")"
+		},
+	}
+	matrixMarkup = markup{
+		tags: map[string][2]string{
+			"b": {"<b>", "</b>"}, "strong": {"<b>", "</b>"}, "i": {"<i>", "</i>"}, "em": {"<i>", "</i>"},
+			"u": {"<u>", "</u>"}, "ins": {"<u>", "</u>"}, "s": {"<del>", "</del>"}, "strike": {"<del>", "</del>"},
+			"del": {"<del>", "</del>"}, "code": {"<code>", "</code>"}, "pre": {"<pre>", "</pre>"},
+			"blockquote": {"<blockquote>", "</blockquote>"}, "tg-spoiler": {"<span data-mx-spoiler>", "</span>"},
+		},
+		link: func(href, text string) string {
+			return `<a href="` + html.EscapeString(href) + `">` + text + "</a>"
+		},
+		escape: func(text string) string {
+			return strings.ReplaceAll(html.EscapeString(text), "\n", "<br>")
+		},
+		preEscape: html.EscapeString,
+	}
+)
+
+// convertHTML converts a message in Telegram HTML to the markup of another
+// chat system. Invalid HTML is converted as plain text, like Telegram gets it.
+func convertHTML(str string, m markup) string {
+	escape := func(text string) string {
+		if m.escape == nil {
+			return text
+		}
+		return m.escape(text)
+	}
+	if validateHTML(str) != nil {
+		return escape(html.UnescapeString(bluemonday.StrictPolicy().Sanitize(str)))
+	}
+
+	d := xml.NewDecoder(strings.NewReader(str))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+
+	// Link texts are built apart, the link markup wraps them
+	out := []*strings.Builder{{}}
+	var hrefs []string
+	pre := 0
+	for {
+		token, err := d.Token()
+		if err != nil {
+			break
+		}
+		w := out[len(out)-1]
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch name := t.Name.Local; {
+			case name == "a":
+				href := ""
+				for _, attr := range t.Attr {
+					if attr.Name.Local == "href" {
+						href = attr.Value
+					}
+				}
+				hrefs = append(hrefs, href)
+				out = append(out, &strings.Builder{})
+			case name == "code" && pre > 0:
+			default:
+				if name == "pre" {
+					pre++
+				}
+				w.WriteString(m.tags[name][0])
+			}
+		case xml.EndElement:
+			switch name := t.Name.Local; {
+			case name == "a" && len(hrefs) > 0:
+				text := out[len(out)-1].String()
+				out = out[:len(out)-1]
+				out[len(out)-1].WriteString(m.link(hrefs[len(hrefs)-1], text))
+				hrefs = hrefs[:len(hrefs)-1]
+			case name == "code" && pre > 0:
+			default:
+				if name == "pre" && pre > 0 {
+					pre--
+				}
+				w.WriteString(m.tags[name][1])
+			}
+		case xml.CharData:
+			if pre > 0 && m.preEscape != nil {
+				w.WriteString(m.preEscape(string(t)))
+			} else {
+				w.WriteString(escape(string(t)))
+			}
+		}
+	}
+	// Links left open by the auto closing of tags
+	for len(out) > 1 {
+		text := out[len(out)-1].String()
+		out = out[:len(out)-1]
+		out[len(out)-1].WriteString(text)
+	}
+	return strings.TrimSpace(out[0].String())
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// notifierRequest is a request a notifier made.
+type notifierRequest struct {
+	method string
+	path   string
+	header http.Header
+	body   map[string]any
+}
+
+func TestNotifiers(t *testing.T) {
+	var got notifierRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = notifierRequest{method: r.Method, path: r.URL.EscapedPath(), header: r.Header}
+		data, _ := io.ReadAll(r.Body)
+		if err := json.Unmarshal(data, &got.body); err != nil {
+			t.Errorf("%s %s: %v", r.Method, r.URL, err)
+		}
+	}))
+	defer server.Close()
+
+	useConfig(&Config{Chats: map[string]ChatConfig{
+		"hook":  {Notifier: &NotifierConfig{Type: "webhook", URL: server.URL + "/hook", Headers: map[string]string{"X-Api-Key": "k3y"}}},
+		"slack": {Notifier: &NotifierConfig{Type: "slack", URL: server.URL + "/slack", Channel: "#ops", Username: "bot"}},
+		"mm":    {Notifier: &NotifierConfig{Type: "mattermost", URL: server.URL + "/mm"}},
+		"room":  {Notifier: &NotifierConfig{Type: "matrix", Homeserver: server.URL + "/", RoomID: "!abc:example.org", AccessToken: "t0ken"}},
+	}})
+
+	text := `<b>Disk</b> full on <a href="https://grafana/d/1">node-1</a>`
+	tests := []struct {
+		chat   string
+		method string
+		path   string
+		header map[string]string
+		body   map[string]any
+	}{
+		{
+			chat:   "hook",
+			method: http.MethodPost,
+			path:   "/hook",
+			header: map[string]string{"X-Api-Key": "k3y", "Content-Type": "application/json"},
+			body:   map[string]any{"chat": "hook", "text": "Disk full on node-1 (https://grafana/d/1)", "html": text},
+		},
+		{
+			chat:   "slack",
+			method: http.MethodPost,
+			path:   "/slack",
+			body:   map[string]any{"text": "*Disk* full on <https://grafana/d/1|node-1>", "channel": "#ops", "username": "bot"},
+		},
+		{
+			chat:   "mm",
+			method: http.MethodPost,
+			path:   "/mm",
+			body:   map[string]any{"text": "**Disk** full on [node-1](https://grafana/d/1)"},
+		},
+		{
+			chat:   "room",
+			method: http.MethodPut,
+			path:   "/_matrix/client/v3/rooms/%21abc:example.org/send/m.room.message/delivery-1",
+			header: map[string]string{"Authorization": "Bearer t0ken"},
+			body: map[string]any{
+				"msgtype":        "m.text",
+				"body":           "Disk full on node-1 (https://grafana/d/1)",
+				"format":         "org.matrix.custom.html",
+				"formatted_body": `<b>Disk</b> full on <a href="https://grafana/d/1">node-1</a>`,
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.chat, func(t *testing.T) {
+			notifier, err := notifierFor(tt.chat)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = notifierRequest{}
+			d := &Delivery{ID: "delivery-1", Notifier: tt.chat, Parts: []string{text}, Alerts: Alerts{Status: "firing"}}
+			if err := notifier.Notify(d); err != nil {
+				t.Fatal(err)
+			}
+
+			if got.method != tt.method || got.path != tt.path {
+				t.Errorf("request = %s %s, want %s %s", got.method, got.path, tt.method, tt.path)
+			}
+			for k, v := range tt.header {
+				if got.header.Get(k) != v {
+					t.Errorf("header %s = %q, want %q", k, got.header.Get(k), v)
+				}
+			}
+			for k, v := range tt.body {
+				if got.body[k] != v {
+					t.Errorf("body %s = %q, want %q", k, got.body[k], v)
+				}
+			}
+		})
+	}
+
+	// Retries of a delivery reuse its Matrix transaction ID
+	notifier, _ := notifierFor("room")
+	for range 2 {
+		if err := notifier.Notify(&Delivery{ID: "delivery-2", Notifier: "room", Parts: []string{"retry"}}); err != nil {
+			t.Fatal(err)
+		}
+		if want := "/_matrix/client/v3/rooms/%21abc:example.org/send/m.room.message/delivery-2"; got.path != want {
+			t.Errorf("retry path = %s, want %s", got.path, want)
+		}
+	}
+
+	if _, err := notifierFor("nobody"); err == nil {
+		t.Error("notifierFor() of an unknown alias = nil error")
+	}
+}
+
+func TestSendJSONErrors(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     int
+		retryAfter string
+		body       string
+		wantErr    bool
+		wantWait   time.Duration
+		permanent  bool
+	}{
+		{name: "ok", status: http.StatusOK},
+		{name: "no content", status: http.StatusNoContent},
+		{name: "rate limited", status: http.StatusTooManyRequests, retryAfter: "7", body: "slow down\n", wantErr: true, wantWait: 7 * time.Second},
+		{name: "rate limited without Retry-After", status: http.StatusTooManyRequests, wantErr: true},
+		{name: "rejected", status: http.StatusForbidden, body: "invalid_token", wantErr: true, permanent: true},
+		{name: "server error", status: http.StatusBadGateway, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.retryAfter != "" {
+					w.Header().Set("Retry-After", tt.retryAfter)
+				}
+				w.WriteHeader(tt.status)
+				io.WriteString(w, tt.body)
+			}))
+			defer server.Close()
+
+			err := sendJSON("test", http.MethodPost, server.URL, nil, map[string]string{"text": "hi"})
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("sendJSON() = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil {
+				return
+			}
+			httpErr, ok := err.(*httpError)
+			if !ok || httpErr.Code != tt.status {
+				t.Fatalf("sendJSON() = %#v, want an httpError %d", err, tt.status)
+			}
+			if want := fmt.Sprintf("HTTP %d: %s", tt.status, strings.TrimSpace(tt.body)); err.Error() != want {
+				t.Errorf("Error() = %q, want %q", err.Error(), want)
+			}
+			if retryAfter(err) != tt.wantWait {
+				t.Errorf("retryAfter() = %v, want %v", retryAfter(err), tt.wantWait)
+			}
+			if permanentError(err) != tt.permanent {
+				t.Errorf("permanentError() = %v, want %v", permanentError(err), tt.permanent)
+			}
+		})
+	}
+
+	if err := sendJSON("test", http.MethodPost, "http://127.0.0.1:0/", nil, nil); err == nil || permanentError(err) {
+		t.Errorf("sendJSON() to a closed port = %v, want a retried error", err)
+	}
+}
+
+func TestConvertHTML(t *testing.T) {
+	tests := []struct {
+		name     string
+		in       string
+		plain    string
+		slack    string
+		markdown string
+		matrix   string
+	}{
+		{
+			name:     "text",
+			in:       "Disk 1 < 2 & 3",
+			plain:    "Disk 1 < 2 & 3",
+			slack:    "Disk 1 &lt; 2 &amp; 3",
+			markdown: "Disk 1 < 2 & 3",
+			matrix:   "Disk 1 &lt; 2 &amp; 3",
+		},
+		{
+			name:     "entities",
+			in:       "1 &lt; 2 &amp;&amp; 3 &gt; 2",
+			plain:    "1 < 2 && 3 > 2",
+			slack:    "1 &lt; 2 &amp;&amp; 3 &gt; 2",
+			markdown: "1 < 2 && 3 > 2",
+			matrix:   "1 &lt; 2 &amp;&amp; 3 &gt; 2",
+		},
+		{
+			name:     "formatting",
+			in:       "<b>bold</b> <i>italic</i> <s>gone</s> <code>x</code>",
+			plain:    "bold italic gone x",
+			slack:    "*bold* _italic_ ~gone~ `x`",
+			markdown: "**bold** _italic_ ~~gone~~ `x`",
+			matrix:   "<b>bold</b> <i>italic</i> <del>gone</del> <code>x</code>",
+		},
+		{
+			name:     "link",
+			in:       `see <a href="https://example.org/?a=1&amp;b=2">the <b>graph</b></a>`,
+			plain:    "see the graph (https://example.org/?a=1&b=2)",
+			slack:    "see <https://example.org/?a=1&b=2|the *graph*>",
+			markdown: "see [the **graph**](https://example.org/?a=1&b=2)",
+			matrix:   `see <a href="https://example.org/?a=1&amp;b=2">the <b>graph</b></a>`,
+		},
+		{
+			name:     "link to itself",
+			in:       `<a href="https://example.org">https://example.org</a>`,
+			plain:    "https://example.org",
+			slack:    "<https://example.org|https://example.org>",
+			markdown: "[https://example.org](https://example.org)",
+			matrix:   `<a href="https://example.org">https://example.org</a>`,
+		},
+		{
+			name:     "pre with code",
+			in:       "<pre><code>a &lt; b\nc</code></pre>",
+			plain:    "a < b\nc",
+			slack:    "```\na &lt; b\nc\n```",
+			markdown: "```\na < b\nc\n```",
+			matrix:   "<pre>a &lt; b\nc</pre>",
+		},
+		{
+			name:     "line breaks",
+			in:       "first\nsecond",
+			plain:    "first\nsecond",
+			slack:    "first\nsecond",
+			markdown: "first\nsecond",
+			matrix:   "first<br>second",
+		},
+		{
+			name:     "unknown tag",
+			in:       "<u>under</u> <tg-spoiler>secret</tg-spoiler>",
+			plain:    "under secret",
+			slack:    "under secret",
+			markdown: "under secret",
+			matrix:   "<u>under</u> <span data-mx-spoiler>secret</span>",
+		},
+		{
+			name:     "invalid HTML",
+			in:       "1 < 2 <b>open",
+			plain:    "1 < 2 open",
+			slack:    "1 &lt; 2 open",
+			markdown: "1 < 2 open",
+			matrix:   "1 &lt; 2 open",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, m := range []struct {
+				name   string
+				markup markup
+				want   string
+			}{
+				{"plain", plainMarkup, tt.plain},
+				{"slack", slackMarkup, tt.slack},
+				{"markdown", markdownMarkup, tt.markdown},
+				{"matrix", matrixMarkup, tt.matrix},
+			} {
+				if got := convertHTML(tt.in, m.markup); got != m.want {
+					t.Errorf("convertHTML(%q, %s) = %q, want %q", tt.in, m.name, got, m.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// Delivery is an alert group rendered for a chat, waiting to be sent.
+type Delivery struct {
+	ID      string `json:"id"`
+	ChatID  int64  `json:"chatId"`
+	TopicID int64  `json:"topicId"`
+	// Chat alias sending to another chat system than Telegram
+	Notifier string                         `json:"notifier,omitempty"`
+	Alerts   Alerts                         `json:"alerts"`
+	Parts    []string                       `json:"parts"`
+	Keyboard *tgbotapi.InlineKeyboardMarkup `json:"keyboard,omitempty"`
+	// Messages of the parts already delivered
+	MessageIDs []int     `json:"messageIds,omitempty"`
+	CreatedAt  time.Time `json:"createdAt"`
+	Attempts   int       `json:"attempts"`
+}
+
+// newDelivery prepares a message for a chat, or for the chat alias of a
+// notifier.
+func newDelivery(chatid int64, topicid int64, notifier string, message Message) *Delivery {
+	cfg := current().cfg
+	if notifier != "" {
+		// Other chat systems take long messages and have no buttons
+		return &Delivery{Notifier: notifier, Alerts: message.Alerts, Parts: []string{message.Text}}
+	}
+	return &Delivery{
+		ChatID:   chatid,
+		TopicID:  topicid,
+		Alerts:   message.Alerts,
+		Parts:    SplitString(message.Text, cfg.SplitMessageBytes),
+		Keyboard: generateInlineKeyboard(message.Alerts),
+	}
+}
+
+// chat returns the chat of a delivery, its chat ID or chat alias, that keys
+// its queue and the state of its alerts.
+func (d *Delivery) chat() string {
+	return chatKey(d.ChatID, d.Notifier)
+}
+
+// deliveryQueue sends deliveries in order per chat and retries failed ones
+// with exponential backoff. Queued deliveries are kept in the store until
+// they are sent or dropped, so they survive restarts.
+type deliveryQueue struct {
+	mu      sync.Mutex
+	chats   map[string]*chatQueue
+	depth   int
+	seq     uint64
+	dropped atomic.Int64
+}
+
+type chatQueue struct {
+	pending []*Delivery
+}
+
+func newDeliveryQueue() *deliveryQueue {
+	return &deliveryQueue{chats: make(map[string]*chatQueue)}
+}
+
+// Enqueue stores deliveries and schedules them, all of them or none: a
+// webhook is either queued whole or refused, so Alertmanager's retry doesn't
+// post its first messages twice. The deliveries are durable once Enqueue
+// returns without error.
+func (q *deliveryQueue) Enqueue(deliveries ...*Delivery) error {
+	cfg := current().cfg
+	q.mu.Lock()
+	if q.depth+len(deliveries) > cfg.Queue.MaxSize {
+		q.mu.Unlock()
+		return fmt.Errorf("message queue is full (%d messages)", cfg.Queue.MaxSize)
+	}
+	// The room is taken before storing, so concurrent webhooks can't overfill the queue
+	q.depth += len(deliveries)
+	now := time.Now()
+	for _, d := range deliveries {
+		q.seq++
+		// Keys sort in enqueue order
+		d.ID = fmt.Sprintf("%020d-%06d", now.UnixNano(), q.seq%1000000)
+	}
+	q.mu.Unlock()
+
+	for i, d := range deliveries {
+		if d.CreatedAt.IsZero() {
+			d.CreatedAt = now
+		}
+		if err := store.Put(bucketQueue, d.ID, d); err != nil {
+			for _, stored := range deliveries[:i] {
+				if err := store.Delete(bucketQueue, stored.ID); err != nil {
+					slog.Error("Can't remove message from queue", "id", stored.ID, "error", err)
+				}
+			}
+			q.mu.Lock()
+			q.depth -= len(deliveries)
+			q.mu.Unlock()
+			return fmt.Errorf("storing message: %w", err)
+		}
+	}
+
+	for _, d := range deliveries {
+		q.push(d)
+	}
+	return nil
+}
+
+// Restore schedules the deliveries left in the store by a previous run.
+func (q *deliveryQueue) Restore() error {
+	var restored []*Delivery
+	err := store.ForEach(bucketQueue, func(key string, value []byte) error {
+		d := &Delivery{}
+		if err := json.Unmarshal(value, d); err != nil {
+			slog.Error("Dropping unreadable queued message", "id", key, "error", err)
+			return nil
+		}
+		restored = append(restored, d)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	q.mu.Lock()
+	q.depth += len(restored)
+	q.mu.Unlock()
+	for _, d := range restored {
+		q.push(d)
+	}
+	if len(restored) > 0 {
+		slog.Info("Restored queued messages", "count", len(restored))
+	}
+	return nil
+}
+
+// Depth returns the number of deliveries waiting in the queue.
+func (q *deliveryQueue) Depth() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.depth
+}
+
+// Dropped returns the number of deliveries given up since start.
+func (q *deliveryQueue) Dropped() int64 {
+	return q.dropped.Load()
+}
+
+// push schedules a delivery counted in the queue depth.
+func (q *deliveryQueue) push(d *Delivery) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	cq, running := q.chats[d.chat()]
+	if !running {
+		cq = &chatQueue{}
+		q.chats[d.chat()] = cq
+	}
+	cq.pending = append(cq.pending, d)
+	if !running {
+		go q.worker(d.chat(), cq)
+	}
+}
+
+// next returns the head of a chat queue, the worker stops when it is empty.
+func (q *deliveryQueue) next(chat string, cq *chatQueue) *Delivery {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(cq.pending) == 0 {
+		delete(q.chats, chat)
+		return nil
+	}
+	return cq.pending[0]
+}
+
+// coalesce replaces the untouched deliveries for the same topic at the head
+// of a chat queue by a single digest delivery and returns the new head.
+func (q *deliveryQueue) coalesce(cq *chatQueue) *Delivery {
+	q.mu.Lock()
+	n := 0
+	for n < len(cq.pending) && digestible(cq.pending[n]) && cq.pending[n].TopicID == cq.pending[0].TopicID {
+		n++
+	}
+	if n < 2 {
+		d := cq.pending[0]
+		q.mu.Unlock()
+		return d
+	}
+
+	merged := cq.pending[:n]
+	d := digest(merged)
+	cq.pending = append([]*Delivery{d}, cq.pending[n:]...)
+	q.depth -= n - 1
+	q.mu.Unlock()
+
+	slog.Info("Chat is rate limited, sending a digest", "chatid", d.ChatID, "messages", n)
+	if err := store.Put(bucketQueue, d.ID, d); err != nil {
+		slog.Error("Can't store digest message", "id", d.ID, "error", err)
+	}
+	for _, m := range merged[1:] {
+		if err := store.Delete(bucketQueue, m.ID); err != nil {
+			slog.Error("Can't remove message from queue", "id", m.ID, "error", err)
+		}
+	}
+	return d
+}
+
+func (q *deliveryQueue) pop(cq *chatQueue, d *Delivery) {
+	if err := store.Delete(bucketQueue, d.ID); err != nil {
+		slog.Error("Can't remove message from queue", "id", d.ID, "error", err)
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	cq.pending = cq.pending[1:]
+	q.depth--
+}
+
+func (q *deliveryQueue) drop(cq *chatQueue, d *Delivery, reason string, err error) {
+	q.dropped.Add(1)
+	slog.Error("Dropping message", "reason", reason, "chat", d.chat(), "groupKey", d.Alerts.GroupKey,
+		"age", time.Since(d.CreatedAt).Round(time.Second), "attempts", d.Attempts, "error", err)
+	q.pop(cq, d)
+}
+
+func (q *deliveryQueue) worker(chat string, cq *chatQueue) {
+	for d := q.next(chat, cq); d != nil; d = q.next(chat, cq) {
+		cfg := current().cfg
+		if time.Since(d.CreatedAt) > cfg.Queue.MaxAge {
+			q.drop(cq, d, "too old", nil)
+			continue
+		}
+
+		notifier, err := notifierFor(d.Notifier)
+		if errors.Is(err, errNotConnected) {
+			// Not an attempt, the bot is still being authorised at startup
+			time.Sleep(cfg.Queue.MinBackoff)
+			continue
+		}
+		if err != nil {
+			// The chat alias was removed by a reload
+			q.drop(cq, d, "no notifier", err)
+			continue
+		}
+
+		// Rather one digest than a backlog of messages trickling in
+		if d.Notifier == "" && chatBudgetExhausted(d.ChatID) {
+			d = q.coalesce(cq)
+		}
+
+		err = notifier.Notify(d)
+		if err == nil {
+			recordAlerts(d)
+			q.pop(cq, d)
+			continue
+		}
+
+		if d.Notifier == "" {
+			recordDeliveryError(d.ChatID, err)
+		}
+		if permanentError(err) {
+			q.drop(cq, d, "rejected", err)
+			continue
+		}
+
+		d.Attempts++
+		wait := retryAfter(err)
+		if wait == 0 {
+			wait = backoff(d.Attempts)
+		}
+		slog.Warn("Error sending message, retrying", "chat", chat, "attempt", d.Attempts, "in", wait, "error", err)
+
+		// Keep the progress of partly delivered messages
+		if err := store.Put(bucketQueue, d.ID, d); err != nil {
+			slog.Error("Can't update queued message", "id", d.ID, "error", err)
+		}
+		time.Sleep(wait)
+	}
+}
+
+// backoff doubles the wait after each failed attempt.
+func backoff(attempts int) time.Duration {
+	cfg := current().cfg
+	wait := cfg.Queue.MinBackoff
+	for i := 1; i < attempts && wait < cfg.Queue.MaxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > cfg.Queue.MaxBackoff {
+		wait = cfg.Queue.MaxBackoff
+	}
+	return wait
+}
+
+// retryAfter returns how long Telegram or a notifier asked us to wait after
+// a 429 response.
+func retryAfter(err error) time.Duration {
+	var tgErr *tgbotapi.Error
+	if errors.As(err, &tgErr) && tgErr.RetryAfter > 0 {
+		return time.Duration(tgErr.RetryAfter) * time.Second
+	}
+	var httpErr *httpError
+	if errors.As(err, &httpErr) {
+		return httpErr.RetryAfter
+	}
+	return 0
+}
+
+// permanentError reports whether Telegram or a notifier refused a message
+// for good, like a bad request or a chat the bot was removed from. Flood
+// control and network errors are worth retrying.
+func permanentError(err error) bool {
+	var tgErr *tgbotapi.Error
+	var httpErr *httpError
+	code := 0
+	switch {
+	case errors.As(err, &tgErr):
+		code = tgErr.Code
+	case errors.As(err, &httpErr):
+		code = httpErr.Code
+	}
+	return code >= 400 && code < 500 && code != 429
+}
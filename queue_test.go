@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestEnqueueAllOrNone(t *testing.T) {
+	cfg := useConfig(&Config{})
+	cfg.Queue.MaxSize = 2
+
+	q := newDeliveryQueue()
+	q.depth = 1
+	deliveries := []*Delivery{
+		{Notifier: "gone", Parts: []string{"one"}},
+		{Notifier: "gone", Parts: []string{"two"}},
+	}
+	if err := q.Enqueue(deliveries...); err == nil {
+		t.Fatal("Enqueue() over max_size succeeded")
+	}
+	if got := q.Depth(); got != 1 {
+		t.Errorf("Depth() = %d after a refused Enqueue, want 1", got)
+	}
+	for _, d := range deliveries {
+		if d.ID == "" {
+			continue
+		}
+		if found, _ := store.Get(bucketQueue, d.ID, &Delivery{}); found {
+			t.Errorf("refused delivery %s was stored", d.ID)
+		}
+	}
+}
+
+func TestEnqueueDeliversInOrder(t *testing.T) {
+	received := make(chan string, 3)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var m webhookMessage
+		json.NewDecoder(r.Body).Decode(&m)
+		received <- m.Text
+	}))
+	defer server.Close()
+
+	useConfig(&Config{Chats: map[string]ChatConfig{
+		"hook": {Notifier: &NotifierConfig{Type: "webhook", URL: server.URL}},
+	}})
+
+	q := newDeliveryQueue()
+	err := q.Enqueue(
+		&Delivery{Notifier: "hook", Parts: []string{"one"}},
+		&Delivery{Notifier: "hook", Parts: []string{"two"}},
+		&Delivery{Notifier: "hook", Parts: []string{"three"}},
+	)
+	if err != nil {
+		t.Fatalf("Enqueue() = %v", err)
+	}
+	for _, want := range []string{"one", "two", "three"} {
+		select {
+		case got := <-received:
+			if got != want {
+				t.Errorf("received %q, want %q", got, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q was not delivered", want)
+		}
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	cfg := useConfig(&Config{})
+	cfg.Queue.MinBackoff = time.Second
+	cfg.Queue.MaxBackoff = 10 * time.Second
+
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.attempts); got != tt.want {
+			t.Errorf("backoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+func TestPermanentError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"bad request", &tgbotapi.Error{Code: 400, Message: "Bad Request: chat not found"}, true},
+		{"forbidden", &tgbotapi.Error{Code: 403, Message: "Forbidden: bot was kicked"}, true},
+		{"flood control", &tgbotapi.Error{Code: 429, Message: "Too Many Requests"}, false},
+		{"telegram down", &tgbotapi.Error{Code: 502, Message: "Bad Gateway"}, false},
+		{"notifier refused", &httpError{Code: 404}, true},
+		{"notifier limited", &httpError{Code: 429}, false},
+		{"notifier down", &httpError{Code: 503}, false},
+		{"network", errors.New("connection refused"), false},
+		{"not connected", errNotConnected, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := permanentError(tt.err); got != tt.want {
+				t.Errorf("permanentError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want time.Duration
+	}{
+		{"telegram", &tgbotapi.Error{Code: 429, ResponseParameters: tgbotapi.ResponseParameters{RetryAfter: 7}}, 7 * time.Second},
+		{"notifier", &httpError{Code: 429, RetryAfter: 3 * time.Second}, 3 * time.Second},
+		{"none", errors.New("timeout"), 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryAfter(tt.err); got != tt.want {
+				t.Errorf("retryAfter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// Token buckets in front of every message sent to Telegram, which allows
+// about 30 messages per second overall and 20 per minute in a group.
+var globalLimiter *rate.Limiter
+
+var chatLimiters = struct {
+	sync.Mutex
+	m map[int64]*rate.Limiter
+}{m: make(map[int64]*rate.Limiter)}
+
+// setupRateLimits creates the global limiter, or applies new limits to the
+// existing limiters after a reload.
+func setupRateLimits(cfg *Config) {
+	if globalLimiter == nil {
+		globalLimiter = rate.NewLimiter(rate.Limit(cfg.RateLimit.Global), max(1, int(cfg.RateLimit.Global)))
+		return
+	}
+	globalLimiter.SetLimit(rate.Limit(cfg.RateLimit.Global))
+	globalLimiter.SetBurst(max(1, int(cfg.RateLimit.Global)))
+
+	chatLimiters.Lock()
+	defer chatLimiters.Unlock()
+	for _, lim := range chatLimiters.m {
+		lim.SetLimit(rate.Limit(cfg.RateLimit.PerChat / 60))
+		lim.SetBurst(max(1, cfg.RateLimit.PerChatBurst))
+	}
+}
+
+func chatLimiter(chatid int64) *rate.Limiter {
+	cfg := current().cfg
+	chatLimiters.Lock()
+	defer chatLimiters.Unlock()
+	lim, ok := chatLimiters.m[chatid]
+	if !ok {
+		lim = rate.NewLimiter(rate.Limit(cfg.RateLimit.PerChat/60), max(1, cfg.RateLimit.PerChatBurst))
+		chatLimiters.m[chatid] = lim
+	}
+	return lim
+}
+
+// waitToSend blocks until both the chat and the global budget allow a message.
+func waitToSend(chatid int64) {
+	start := time.Now()
+	chatLimiter(chatid).Wait(context.Background())
+	globalLimiter.Wait(context.Background())
+	if waited := time.Since(start); waited > time.Second {
+		slog.Debug("Rate limited", "chatid", chatid, "waited", waited.Round(time.Millisecond))
+	}
+}
+
+// chatBudgetExhausted reports whether a chat has to wait before its next message.
+func chatBudgetExhausted(chatid int64) bool {
+	return chatLimiter(chatid).Tokens() < 1
+}
+
+// digestible reports whether a delivery can be merged into a digest. Partly
+// delivered ones continue where they stopped, the buttons of the Silence and
+// Ack actions belong to their own group, and with edit_messages the message
+// of a group is edited in place.
+func digestible(d *Delivery) bool {
+	if len(d.MessageIDs) > 0 || (current().cfg.EditMessages && d.Alerts.GroupKey != "") {
+		return false
+	}
+	if d.Keyboard != nil {
+		for _, row := range d.Keyboard.InlineKeyboard {
+			for _, btn := range row {
+				if btn.CallbackData != nil {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// digest merges queued deliveries of a chat into a single message.
+func digest(pending []*Delivery) *Delivery {
+	cfg := current().cfg
+	first := pending[0]
+	d := &Delivery{
+		ID:        first.ID,
+		ChatID:    first.ChatID,
+		TopicID:   first.TopicID,
+		CreatedAt: first.CreatedAt,
+	}
+	d.Alerts.Status = "resolved"
+
+	texts := []string{fmt.Sprintf("<b>📦 %d notifications</b>", len(pending))}
+	for _, p := range pending {
+		texts = append(texts, strings.Join(p.Parts, ""))
+		// Keep the alerts, so their state is recorded
+		d.Alerts.Alerts = append(d.Alerts.Alerts, p.Alerts.Alerts...)
+		if p.Alerts.Status == "firing" {
+			d.Alerts.Status = "firing"
+		}
+	}
+	d.Parts = SplitString(strings.Join(texts, "\n\n➖➖➖\n\n"), cfg.SplitMessageBytes)
+
+	return d
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+func TestCoalesce(t *testing.T) {
+	ackButtons := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonData("Ack", "ack:token")))
+	linkButtons := tgbotapi.NewInlineKeyboardMarkup(tgbotapi.NewInlineKeyboardRow(tgbotapi.NewInlineKeyboardButtonURL("Graph", "https://grafana")))
+	message := func(text string, topic int64) *Delivery {
+		return &Delivery{
+			ChatID:  -9,
+			TopicID: topic,
+			Parts:   []string{text},
+			Alerts:  Alerts{GroupKey: "group-" + text, Status: "resolved", Alerts: []Alert{{Status: "resolved"}}},
+		}
+	}
+
+	tests := []struct {
+		name    string
+		edit    bool
+		pending func() []*Delivery
+		// Deliveries left in the queue, the first one the digest of merged
+		want   int
+		merged int
+	}{
+		{
+			name:    "single message",
+			pending: func() []*Delivery { return []*Delivery{message("a", 0)} },
+			want:    1,
+		},
+		{
+			name:    "same topic",
+			pending: func() []*Delivery { return []*Delivery{message("a", 0), message("b", 0), message("c", 0)} },
+			want:    1,
+			merged:  3,
+		},
+		{
+			name:    "topic boundary",
+			pending: func() []*Delivery { return []*Delivery{message("a", 0), message("b", 0), message("c", 5)} },
+			want:    2,
+			merged:  2,
+		},
+		{
+			name: "partly delivered head",
+			pending: func() []*Delivery {
+				head := message("a", 0)
+				head.MessageIDs = []int{1}
+				return []*Delivery{head, message("b", 0)}
+			},
+			want: 2,
+		},
+		{
+			name: "action buttons",
+			pending: func() []*Delivery {
+				acked := message("b", 0)
+				acked.Keyboard = &ackButtons
+				return []*Delivery{message("a", 0), acked, message("c", 0)}
+			},
+			want: 3,
+		},
+		{
+			name: "link buttons",
+			pending: func() []*Delivery {
+				linked := message("b", 0)
+				linked.Keyboard = &linkButtons
+				return []*Delivery{message("a", 0), linked}
+			},
+			want:   1,
+			merged: 2,
+		},
+		{
+			name:    "edited groups",
+			edit:    true,
+			pending: func() []*Delivery { return []*Delivery{message("a", 0), message("b", 0)} },
+			want:    2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(&Config{EditMessages: tt.edit})
+			q := newDeliveryQueue()
+			pending := tt.pending()
+			for i, d := range pending {
+				d.ID = fmt.Sprintf("coalesce-%s-%d", tt.name, i)
+			}
+			cq := &chatQueue{pending: pending}
+			q.depth = len(pending)
+			head := pending[0]
+
+			d := q.coalesce(cq)
+			if len(cq.pending) != tt.want || q.Depth() != tt.want || cq.pending[0] != d {
+				t.Fatalf("queue = %d deliveries, depth %d, want %d with the result first", len(cq.pending), q.Depth(), tt.want)
+			}
+			if tt.merged == 0 {
+				if d != head {
+					t.Errorf("coalesce() merged deliveries, want the head unchanged")
+				}
+				return
+			}
+			if d.ID != head.ID || len(d.Alerts.Alerts) != tt.merged || d.Keyboard != nil || d.Alerts.GroupKey != "" {
+				t.Errorf("digest = %+v, want %d merged alerts under the head's ID", d, tt.merged)
+			}
+			if text := strings.Join(d.Parts, ""); !strings.Contains(text, "📦") || !strings.Contains(text, "a") {
+				t.Errorf("digest text = %q", text)
+			}
+		})
+	}
+}
+
+func TestDigestStatus(t *testing.T) {
+	useConfig(&Config{})
+	d := digest([]*Delivery{
+		{ChatID: 1, Parts: []string{"resolved"}, Alerts: Alerts{Status: "resolved"}},
+		{ChatID: 1, Parts: []string{"firing"}, Alerts: Alerts{Status: "firing"}},
+	})
+	if d.Alerts.Status != "firing" {
+		t.Errorf("digest status = %s, want firing when one message fires", d.Alerts.Status)
+	}
+	if text := strings.Join(d.Parts, ""); !strings.HasPrefix(text, "<b>📦 2 notifications</b>") {
+		t.Errorf("digest text = %q, want the count first", text)
+	}
+}
+
+func TestChatBudgetExhausted(t *testing.T) {
+	cfg := &Config{}
+	cfg.RateLimit.PerChat = 1
+	cfg.RateLimit.PerChatBurst = 2
+	useConfig(cfg)
+	const chatid = -9009
+
+	for i := range 2 {
+		if chatBudgetExhausted(chatid) {
+			t.Fatalf("budget exhausted after %d messages, want a burst of 2", i)
+		}
+		start := time.Now()
+		waitToSend(chatid)
+		if waited := time.Since(start); waited > time.Second {
+			t.Fatalf("message %d waited %v within the burst", i, waited)
+		}
+	}
+	if !chatBudgetExhausted(chatid) {
+		t.Error("budget left after the burst, want it exhausted")
+	}
+}
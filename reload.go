@@ -0,0 +1,156 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/gin-gonic/gin"
+	tgbotapi "github.com/go-telegram-bot-api/telegram-bot-api/v5"
+)
+
+// snapshot is the running configuration: the bot, the settings and the
+// templates. A published snapshot is never modified, a reload publishes a
+// new one, so webhooks, Telegram updates, queue workers and metrics load it
+// once per use without locking.
+type snapshot struct {
+	// nil until Telegram accepted the token
+	bot  *tgbotapi.BotAPI
+	cfg  *Config
+	tmpl *template.Template
+	// Named templates from the templates section, and the templates routes
+	// load by path, by name or path
+	templates map[string]*template.Template
+}
+
+var running atomic.Pointer[snapshot]
+
+// current returns the running configuration.
+func current() *snapshot {
+	return running.Load()
+}
+
+// publishLock serializes the changes of the running configuration, by
+// reloads and by the startup once the bot is authorised.
+var publishLock sync.Mutex
+
+// publish makes s the running configuration.
+func publish(s *snapshot) {
+	running.Store(s)
+	setupLogging(s.cfg.LogLevel)
+	setupRateLimits(s.cfg)
+}
+
+// reloadConfig re-reads the configuration, the token file and the templates,
+// and swaps them in only when all of them are valid.
+func reloadConfig() error {
+	newCfg, newTmpl, newTemplates, err := loadConfig(true)
+	if err != nil {
+		return err
+	}
+
+	publishLock.Lock()
+	defer publishLock.Unlock()
+	old := current()
+	next := &snapshot{bot: old.bot, cfg: newCfg, tmpl: newTmpl, templates: newTemplates}
+
+	// A new token gets a new bot, checked before anything changes. The bot
+	// is still being authorised at startup when there is none yet.
+	if old.bot != nil && newCfg.TelegramToken != old.cfg.TelegramToken {
+		next.bot, err = newBot(newCfg.TelegramToken)
+		if err != nil {
+			return fmt.Errorf("new telegram token is not valid: %w", err)
+		}
+	}
+
+	if newCfg.Storage != old.cfg.Storage {
+		slog.Warn("Storage settings changed, restart the bot to apply them")
+	}
+	if newCfg.TLS != old.cfg.TLS || newCfg.ListenMode != old.cfg.ListenMode {
+		slog.Warn("TLS settings changed, restart the bot to apply them")
+	}
+	if newCfg.SendOnly != old.cfg.SendOnly {
+		slog.Warn("send_only changed, restart the bot to apply it")
+	}
+
+	publish(next)
+	warnMigratedChats(next.cfg)
+	warnAuthorization(next.cfg)
+	if next.bot != old.bot {
+		slog.Info("Authorised on account", "username", next.bot.Self.UserName)
+		if !old.cfg.SendOnly {
+			// The long-poller of the old token stops, the new bot gets its own
+			old.bot.StopReceivingUpdates()
+			startPolling(next.bot)
+		}
+	}
+
+	return nil
+}
+
+// newBot authorises a token with Telegram.
+func newBot(token string) (*tgbotapi.BotAPI, error) {
+	return tgbotapi.NewBotAPIWithClient(token, tgbotapi.APIEndpoint, instrumentedClient{&http.Client{}})
+}
+
+// reload applies a new configuration or keeps the running one.
+func reload(trigger string) error {
+	err := reloadConfig()
+	if err != nil {
+		slog.Error("Configuration reload failed, keeping the running configuration", "trigger", trigger, "error", err)
+		return err
+	}
+	slog.Info("Configuration reloaded", "trigger", trigger)
+	return nil
+}
+
+// reloadOnSIGHUP reloads the configuration each time the process gets SIGHUP.
+func reloadOnSIGHUP() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+	for range signals {
+		reload("SIGHUP")
+	}
+}
+
+// POST_Reload reloads the configuration. It needs the reload_token as a
+// bearer token, or a request from localhost or the Unix socket when no
+// token is configured.
+func POST_Reload(c *gin.Context) {
+	token := current().cfg.ReloadToken
+
+	if token != "" {
+		given := c.GetHeader("Authorization")
+		if subtle.ConstantTimeCompare([]byte(given), []byte("Bearer "+token)) != 1 {
+			c.JSON(http.StatusUnauthorized, gin.H{"err": "invalid reload token"})
+			return
+		}
+	} else if !isLocalRequest(c) {
+		c.JSON(http.StatusForbidden, gin.H{"err": "set reload_token to reload from another host"})
+		return
+	}
+
+	if err := reload("http"); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"err": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "reloaded"})
+}
+
+// isLocalRequest reports whether a request comes from localhost, or from
+// a peer of the Unix socket, which has no IP address.
+func isLocalRequest(c *gin.Context) bool {
+	if addr, ok := c.Request.Context().Value(http.LocalAddrContextKey).(net.Addr); ok && addr.Network() == "unix" {
+		return true
+	}
+	ip := c.RemoteIP()
+	return ip == "127.0.0.1" || ip == "::1"
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReloadConfig(t *testing.T) {
+	useConfig(&Config{TelegramToken: "x"})
+
+	useConfigFile(t, "telegram_token: x\nsplit_msg_byte: 1000")
+	if err := reloadConfig(); err != nil {
+		t.Fatalf("reloadConfig() = %v", err)
+	}
+	valid := current()
+	if valid.cfg.SplitMessageBytes != 1000 {
+		t.Errorf("split_msg_byte = %d after the reload, want 1000", valid.cfg.SplitMessageBytes)
+	}
+
+	useConfigFile(t, "telegram_token: x\nsplit_msg_byte: 5000")
+	if err := reloadConfig(); err == nil {
+		t.Error("reloadConfig() of an invalid config succeeded")
+	}
+	if current() != valid {
+		t.Error("an invalid config replaced the running one")
+	}
+}
+
+func TestPOSTReload(t *testing.T) {
+	router := gin.New()
+	router.POST("/-/reload", POST_Reload)
+
+	tests := []struct {
+		name   string
+		token  string
+		remote string
+		bearer string
+		want   int
+	}{
+		{name: "token", token: "s3cret", remote: "10.0.0.1:4000", bearer: "s3cret", want: http.StatusOK},
+		{name: "wrong token", token: "s3cret", remote: "127.0.0.1:4000", bearer: "guess", want: http.StatusUnauthorized},
+		{name: "missing token", token: "s3cret", remote: "127.0.0.1:4000", want: http.StatusUnauthorized},
+		{name: "localhost without token", remote: "127.0.0.1:4000", want: http.StatusOK},
+		{name: "remote without token", remote: "10.0.0.1:4000", want: http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			useConfig(&Config{TelegramToken: "x", ReloadToken: tt.token})
+			useConfigFile(t, "telegram_token: x\nreload_token: '"+tt.token+"'")
+
+			req := httptest.NewRequest(http.MethodPost, "/-/reload", nil)
+			req.RemoteAddr = tt.remote
+			if tt.bearer != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.bearer)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("POST /-/reload = %d %s, want %d", w.Code, w.Body, tt.want)
+			}
+		})
+	}
+
+	// An invalid config is refused, the running one is kept
+	useConfig(&Config{TelegramToken: "x"})
+	useConfigFile(t, "telegram_token: x\nlog_level: LOUD")
+	req := httptest.NewRequest(http.MethodPost, "/-/reload", nil)
+	req.RemoteAddr = "127.0.0.1:4000"
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("POST /-/reload with an invalid config = %d, want 400", w.Code)
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+)
+
+// Tags Telegram accepts in HTML messages
+var telegramTags = map[string]bool{
+	"b": true, "strong": true, "i": true, "em": true, "u": true, "ins": true,
+	"s": true, "strike": true, "del": true, "span": true, "tg-spoiler": true,
+	"a": true, "tg-emoji": true, "code": true, "pre": true, "blockquote": true,
+}
+
+// formatErrorSeen is called with each value a template function could not
+// format, render fails on them.
+var formatErrorSeen = func(fn string, err error) {}
+
+// runRender renders an alert manager webhook offline, to check a template
+// without a token or a chat. It returns the exit code.
+func runRender(args []string) int {
+	fs := flag.NewFlagSet("render", flag.ContinueOnError)
+	tmplFile := fs.String("t", "", "Path to a template file")
+	input := fs.String("i", "", "Path to an alert manager webhook JSON file")
+	confFile := fs.String("c", "", "Path to a config file, for time settings, split_msg_byte and named templates")
+	format := fs.String("f", "alert", "Format of the input: alert, grafana or generic")
+	tz := fs.String("tz", "", "Time zone of the dates, like Europe/Berlin, instead of time_zone of the config")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: prometheus_bot render -t template.tmpl -i alert.json [-c config.yaml] [-f grafana] [-tz Europe/Berlin]")
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	decode, known := inputAdapters[*format]
+	if *input == "" || !known {
+		fs.Usage()
+		return 2
+	}
+
+	// Logs go to stderr, the rendered messages to stdout
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelWarn})))
+
+	s := &snapshot{}
+	var err error
+	if *confFile != "" {
+		*config_path = *confFile
+		*template_path = *tmplFile
+		s.cfg, s.tmpl, s.templates, err = loadConfig(false)
+	} else {
+		s.cfg = &Config{TemplatePath: *tmplFile}
+		setDefaults(s.cfg)
+		if s.cfg.TemplatePath != "" {
+			s.tmpl, err = parseTemplate(s.cfg.TemplatePath)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if *tz != "" {
+		if _, err := time.LoadLocation(*tz); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return 2
+		}
+		s.cfg.TimeZone = *tz
+	} else if s.cfg.TimeZone == "" {
+		fmt.Fprintln(os.Stderr, "time_zone is not set, dates are rendered in UTC, set it with -tz")
+		s.cfg.TimeZone = "UTC"
+	}
+	if s.cfg.TimeOutFormat == "" {
+		fmt.Fprintln(os.Stderr, "time_outdata is not set, dates are rendered in RFC 3339")
+		s.cfg.TimeOutFormat = time.RFC3339
+	}
+	running.Store(s)
+
+	file, err := os.Open(*input)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	defer file.Close()
+	alerts, err := decode(file)
+	var problem PayloadProblem
+	if errors.As(err, &problem) {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", *input, problem)
+		return 1
+	} else if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: invalid JSON: %s\n", *input, jsonError(err))
+		return 1
+	}
+
+	ok := true
+	// The webhook handlers would answer 400, render it anyway
+	for _, problem := range validateAlerts(alerts) {
+		fmt.Printf("INVALID WEBHOOK: %s\n", problem)
+		ok = false
+	}
+	var formatProblems []string
+	defer func(seen func(string, error)) { formatErrorSeen = seen }(formatErrorSeen)
+	formatErrorSeen = func(fn string, err error) {
+		formatProblems = append(formatProblems, fmt.Sprintf("%s: %v", fn, err))
+	}
+	messages := renderMessages(alerts, "")
+	for _, problem := range formatProblems {
+		fmt.Printf("FORMAT ERROR: %s, the message shows it in brackets\n", problem)
+		ok = false
+	}
+	for i, message := range messages {
+		fmt.Printf("=== Message %d of %d: %s, %d alerts\n", i+1, len(messages), message.Alerts.Status, len(message.Alerts.Alerts))
+		if message.Err != nil {
+			fmt.Printf("TEMPLATE ERROR: %v\n", message.Err)
+			ok = false
+		}
+		if problems := htmlProblems(message.Text); len(problems) > 0 {
+			for _, problem := range problems {
+				fmt.Printf("INVALID HTML: %s\n", problem)
+			}
+			ok = false
+		}
+
+		parts := SplitString(message.Text, s.cfg.SplitMessageBytes)
+		for j, part := range parts {
+			fmt.Printf("--- Part %d of %d, %d bytes\n", j+1, len(parts), len(part))
+			if err := validateHTML(part); err != nil {
+				fmt.Printf("INVALID HTML: %v, the part is sent with all tags stripped\n", err)
+				ok = false
+			}
+			fmt.Println(SanitizeMsg(part))
+		}
+	}
+
+	if !ok {
+		return 1
+	}
+	fmt.Println("=== OK")
+	return 0
+}
+
+// htmlProblems lists why str is not a valid Telegram HTML message.
+func htmlProblems(str string) []string {
+	if err := validateHTML(str); err != nil {
+		return []string{err.Error()}
+	}
+
+	var problems []string
+	d := xml.NewDecoder(strings.NewReader(str))
+	d.Strict = false
+	d.AutoClose = xml.HTMLAutoClose
+	d.Entity = xml.HTMLEntity
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return append(problems, err.Error())
+		}
+		if start, ok := token.(xml.StartElement); ok && !telegramTags[start.Name.Local] {
+			problems = append(problems, fmt.Sprintf("line %d: tag <%s> is not supported by Telegram", lineOf(str, d.InputOffset()), start.Name.Local))
+		}
+	}
+	return problems
+}
+
+// lineOf returns the line number of a byte offset in str.
+func lineOf(str string, offset int64) int {
+	return strings.Count(str[:min(int(offset), len(str))], "\n") + 1
+}
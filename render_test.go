@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// captureStdout returns what fn prints to stdout.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	out := make(chan string)
+	go func() {
+		data, _ := io.ReadAll(r)
+		out <- string(data)
+	}()
+	fn()
+	w.Close()
+	return <-out
+}
+
+func TestRunRender(t *testing.T) {
+	dir := t.TempDir()
+	good := writeFile(t, dir, "good.tmpl", `<b>{{ .Status }}</b> {{ len .Alerts }}`)
+	badHTML := writeFile(t, dir, "html.tmpl", `<b>{{ .Status }}`)
+	badValue := writeFile(t, dir, "value.tmpl", `{{ range .Alerts }}{{ str_Format_Byte "lots" 0 }}{{ end }}`)
+	dates := writeFile(t, dir, "dates.tmpl", `{{ range .Alerts }}{{ str_FormatDate .StartsAt }}{{ end }}`)
+	input := filepath.Join("testdata", "production_example.json")
+
+	tests := []struct {
+		name string
+		args []string
+		want int
+		// Part of the output
+		out string
+	}{
+		{"valid", []string{"-t", good, "-i", input}, 0, "=== Message 1 of 1"},
+		{"invalid HTML", []string{"-t", badHTML, "-i", input}, 1, "INVALID HTML"},
+		{"format error", []string{"-t", badValue, "-i", input}, 1, "FORMAT ERROR: str_Format_Byte"},
+		{"dates without a time zone", []string{"-t", dates, "-i", input}, 0, ""},
+		{"dates with a time zone", []string{"-t", dates, "-i", input, "-tz", "Europe/Berlin"}, 0, ""},
+		{"unknown time zone", []string{"-t", dates, "-i", input, "-tz", "Mars/Olympus"}, 2, ""},
+		{"no input", []string{"-t", good}, 2, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got int
+			out := captureStdout(t, func() { got = runRender(tt.args) })
+			if got != tt.want {
+				t.Errorf("runRender(%q) = %d, want %d", tt.args, got, tt.want)
+			}
+			if !strings.Contains(out, tt.out) {
+				t.Errorf("runRender(%q) printed %q, want %q in it", tt.args, out, tt.out)
+			}
+		})
+	}
+	useConfig(&Config{})
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"html/template"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Route is a node of the routing tree. Like in Alertmanager, an alert goes
+// down to the deepest matching route, and evaluation of siblings stops at
+// the first match unless Continue is set.
+type Route struct {
+	Matchers []string      `yaml:"matchers"`
+	Targets  []RouteTarget `yaml:"targets"`
+	Template string        `yaml:"template"`
+	Continue bool          `yaml:"continue"`
+	Routes   []Route       `yaml:"routes"`
+
+	matchers []labelMatcher
+}
+
+// RouteTarget is a chat, and optionally a topic, that receives the alerts of
+// a route. The chat is either a chat_id or an alias from the chats section.
+type RouteTarget struct {
+	Chat     string `yaml:"chat"`
+	ChatID   int64  `yaml:"chat_id"`
+	TopicID  int64  `yaml:"topic_id"`
+	Template string `yaml:"template"`
+
+	// The chat alias, when it sends with a notifier instead of Telegram
+	notifier string
+}
+
+type labelMatcher struct {
+	name  string
+	op    string
+	value string
+	re    *regexp.Regexp
+}
+
+var matcherRE = regexp.MustCompile(`^\s*([a-zA-Z_][a-zA-Z0-9_]*)\s*(=~|!~|!=|=)\s*(.*?)\s*$`)
+
+// parseMatcher parses an Alertmanager style matcher like severity="critical",
+// team=~"db|infra" or env!=dev.
+func parseMatcher(s string) (labelMatcher, error) {
+	m := matcherRE.FindStringSubmatch(s)
+	if m == nil {
+		return labelMatcher{}, fmt.Errorf("bad matcher %q", s)
+	}
+
+	value := m[3]
+	if strings.HasPrefix(value, `"`) {
+		unquoted, err := strconv.Unquote(value)
+		if err != nil {
+			return labelMatcher{}, fmt.Errorf("bad matcher value in %q: %w", s, err)
+		}
+		value = unquoted
+	}
+
+	lm := labelMatcher{name: m[1], op: m[2], value: value}
+	if lm.op == "=~" || lm.op == "!~" {
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return labelMatcher{}, fmt.Errorf("bad regex in %q: %w", s, err)
+		}
+		lm.re = re
+	}
+	return lm, nil
+}
+
+func (m labelMatcher) matches(labels map[string]string) bool {
+	value := labels[m.name]
+	switch m.op {
+	case "=":
+		return value == m.value
+	case "!=":
+		return value != m.value
+	case "=~":
+		return m.re.MatchString(value)
+	case "!~":
+		return !m.re.MatchString(value)
+	}
+	return false
+}
+
+func (m labelMatcher) String() string {
+	return fmt.Sprintf("%s%s%q", m.name, m.op, m.value)
+}
+
+// prepareRoutes parses the matchers, resolves the chat aliases of c and loads
+// the templates of the routing tree into templates. It reports all the
+// problems of the tree at once.
+func prepareRoutes(routes []Route, c *Config, templates map[string]*template.Template) error {
+	var errs []error
+	for i := range routes {
+		r := &routes[i]
+		r.matchers = r.matchers[:0]
+		for _, s := range r.Matchers {
+			m, err := parseMatcher(s)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("routes: %w", err))
+				continue
+			}
+			r.matchers = append(r.matchers, m)
+		}
+
+		names := []string{r.Template}
+		for j := range r.Targets {
+			t := &r.Targets[j]
+			if t.Chat != "" {
+				alias, ok := c.Chats[t.Chat]
+				if !ok {
+					errs = append(errs, fmt.Errorf("routes: unknown chat alias %q", t.Chat))
+					continue
+				}
+				t.ChatID = alias.ID
+				if t.TopicID == 0 {
+					t.TopicID = alias.Topic
+				}
+				if alias.Notifier != nil {
+					t.notifier = t.Chat
+				}
+				t.Chat = ""
+			}
+			if t.ChatID == 0 && t.notifier == "" {
+				errs = append(errs, fmt.Errorf("routes: target without chat or chat_id"))
+			}
+			names = append(names, t.Template)
+		}
+		for _, tmpl := range names {
+			if err := addTemplate(c, templates, tmpl); err != nil {
+				errs = append(errs, fmt.Errorf("routes: %w", err))
+			}
+		}
+
+		if err := prepareRoutes(r.Routes, c, templates); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (r *Route) matches(labels map[string]string) bool {
+	for _, m := range r.matchers {
+		if !m.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchRoutes returns the targets for an alert, inherited targets and
+// templates come from the parent route.
+func matchRoutes(routes []Route, labels map[string]string, parentTargets []RouteTarget, parentTemplate string) []RouteTarget {
+	var res []RouteTarget
+
+	for i := range routes {
+		r := &routes[i]
+		if !r.matches(labels) {
+			continue
+		}
+
+		targets := r.Targets
+		if len(targets) == 0 {
+			targets = parentTargets
+		}
+		tmpl := r.Template
+		if tmpl == "" {
+			tmpl = parentTemplate
+		}
+
+		children := matchRoutes(r.Routes, labels, targets, tmpl)
+		if len(children) > 0 {
+			res = append(res, children...)
+		} else {
+			for _, t := range targets {
+				if t.Template == "" {
+					t.Template = tmpl
+				}
+				res = append(res, t)
+			}
+		}
+
+		if !r.Continue {
+			break
+		}
+	}
+
+	return res
+}
+
+// routeAlerts splits a webhook into one group of alerts per target.
+func routeAlerts(alerts Alerts) (map[RouteTarget]Alerts, []Alert) {
+	cfg := current().cfg
+	groups := make(map[RouteTarget]Alerts)
+	// A chat gets one group per webhook, rendered with the template of the
+	// first route that picked it, in alert order
+	chosen := make(map[RouteTarget]RouteTarget)
+	var unrouted []Alert
+
+	for _, alert := range alerts.Alerts {
+		targets := matchRoutes(cfg.Routes, alert.Labels, nil, "")
+		if len(targets) == 0 {
+			unrouted = append(unrouted, alert)
+			continue
+		}
+
+		seen := make(map[RouteTarget]bool)
+		for _, t := range targets {
+			chat := t
+			chat.Template = ""
+			if seen[chat] {
+				continue
+			}
+			seen[chat] = true
+			if first, ok := chosen[chat]; ok {
+				t = first
+			} else {
+				chosen[chat] = t
+			}
+
+			group, ok := groups[t]
+			if !ok {
+				group = alerts
+				group.Alerts = nil
+			}
+			group.Alerts = append(group.Alerts, alert)
+			groups[t] = group
+		}
+	}
+
+	// A part of a resolved group is resolved as well, a part of a firing
+	// group is firing only if it still has firing alerts
+	for t, group := range groups {
+		group.Status = "resolved"
+		for _, alert := range group.Alerts {
+			if alert.Status == "firing" {
+				group.Status = "firing"
+				break
+			}
+		}
+		groups[t] = group
+	}
+
+	return groups, unrouted
+}
+
+// POST_RoutedHandling delivers alerts to the chats picked by the routing rules.
+func POST_RoutedHandling(c *gin.Context) {
+	// A template in the query overrides the ones of the routes
+	queryTemplate, ok := templateName(c)
+	if !ok {
+		return
+	}
+
+	alerts, ok := readAlerts(c)
+	if !ok {
+		return
+	}
+	countWebhook(c, alerts)
+	forgetCallbacks(alerts)
+
+	groups, unrouted := routeAlerts(alerts)
+	slog.Info("Bot routed alert post", "receiver", alerts.Receiver, "targets", len(groups), "unrouted", len(unrouted))
+	for _, alert := range unrouted {
+		slog.Warn("No route for alert", "labels", alert.Labels)
+	}
+
+	targets := make([]RouteTarget, 0, len(groups))
+	for t := range groups {
+		targets = append(targets, t)
+	}
+	sort.Slice(targets, func(i, j int) bool {
+		if targets[i].ChatID != targets[j].ChatID {
+			return targets[i].ChatID < targets[j].ChatID
+		}
+		if targets[i].notifier != targets[j].notifier {
+			return targets[i].notifier < targets[j].notifier
+		}
+		return targets[i].TopicID < targets[j].TopicID
+	})
+
+	var deliveries []*Delivery
+	queued := 0
+	for _, t := range targets {
+		group, changed := changedAlerts(migratedChatID(t.ChatID), t.TopicID, t.notifier, groups[t])
+		if !changed {
+			continue
+		}
+		queued++
+		tmplName := t.Template
+		if queryTemplate != "" {
+			tmplName = queryTemplate
+		}
+		for _, message := range renderMessages(group, tmplName) {
+			deliveries = append(deliveries, newDelivery(migratedChatID(t.ChatID), t.TopicID, t.notifier, message))
+		}
+	}
+
+	// All the chats get the webhook or none, Alertmanager retries it whole
+	if err := queue.Enqueue(deliveries...); err != nil {
+		slog.Error("Error queueing message", "receiver", alerts.Receiver, "error", err)
+		c.JSON(http.StatusServiceUnavailable, gin.H{
+			"err": fmt.Sprint(err),
+		})
+		return
+	}
+	c.String(http.StatusOK, fmt.Sprintf("telegram msg queued for %d chats.", queued))
+}
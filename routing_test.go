@@ -0,0 +1,96 @@
+package main
+
+import (
+	"html/template"
+	"reflect"
+	"testing"
+)
+
+func TestParseMatcher(t *testing.T) {
+	tests := []struct {
+		matcher string
+		labels  map[string]string
+		want    bool
+		wantErr bool
+	}{
+		{matcher: `severity="critical"`, labels: map[string]string{"severity": "critical"}, want: true},
+		{matcher: `severity=critical`, labels: map[string]string{"severity": "warning"}, want: false},
+		{matcher: `env!=dev`, labels: map[string]string{"env": "prod"}, want: true},
+		{matcher: `env!=dev`, labels: map[string]string{}, want: true},
+		{matcher: `team=~"db|infra"`, labels: map[string]string{"team": "db"}, want: true},
+		{matcher: `team=~"db|infra"`, labels: map[string]string{"team": "dba"}, want: false},
+		{matcher: `team!~"db.*"`, labels: map[string]string{"team": "web"}, want: true},
+		{matcher: `team=~"("`, wantErr: true},
+		{matcher: `not a matcher`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.matcher, func(t *testing.T) {
+			m, err := parseMatcher(tt.matcher)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseMatcher() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && m.matches(tt.labels) != tt.want {
+				t.Errorf("matches(%v) = %v, want %v", tt.labels, !tt.want, tt.want)
+			}
+		})
+	}
+}
+
+func TestRouteAlerts(t *testing.T) {
+	parsed := template.Must(template.New("").Parse(""))
+	cfg := useConfig(&Config{Routes: []Route{
+		{
+			Matchers: []string{`team="db"`},
+			Template: "short",
+			Targets:  []RouteTarget{{ChatID: 1}},
+			Continue: true,
+		},
+		{
+			Matchers: []string{`severity="critical"`},
+			Template: "long",
+			Targets:  []RouteTarget{{ChatID: 1}, {ChatID: 2}},
+			Routes: []Route{
+				{Matchers: []string{`env="dev"`}, Targets: []RouteTarget{{ChatID: 3}}},
+			},
+		},
+	}})
+	cfg.templateFiles = map[string]string{}
+	if err := prepareRoutes(cfg.Routes, cfg, map[string]*template.Template{"short": parsed, "long": parsed}); err != nil {
+		t.Fatal(err)
+	}
+
+	alerts := Alerts{Status: "firing", Alerts: []Alert{
+		{Status: "firing", Labels: map[string]string{"alertname": "A", "team": "db", "severity": "critical"}},
+		{Status: "resolved", Labels: map[string]string{"alertname": "B", "team": "web", "severity": "critical"}},
+		{Status: "firing", Labels: map[string]string{"alertname": "C", "team": "web", "severity": "critical", "env": "dev"}},
+		{Status: "firing", Labels: map[string]string{"alertname": "D", "team": "web"}},
+	}}
+	groups, unrouted := routeAlerts(alerts)
+
+	names := func(group Alerts) []string {
+		var res []string
+		for _, a := range group.Alerts {
+			res = append(res, a.Labels["alertname"])
+		}
+		return res
+	}
+	want := map[RouteTarget][]string{
+		// Both routes pick chat 1, it gets one group with the first template
+		{ChatID: 1, Template: "short"}: {"A", "B"},
+		{ChatID: 2, Template: "long"}:  {"A", "B"},
+		{ChatID: 3, Template: "long"}:  {"C"},
+	}
+	got := map[RouteTarget][]string{}
+	for target, group := range groups {
+		got[target] = names(group)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("routeAlerts() groups = %v, want %v", got, want)
+	}
+	if len(unrouted) != 1 || unrouted[0].Labels["alertname"] != "D" {
+		t.Errorf("routeAlerts() unrouted = %v, want D", unrouted)
+	}
+	if status := groups[RouteTarget{ChatID: 3, Template: "long"}].Status; status != "firing" {
+		t.Errorf("group of chat 3 is %s, want firing", status)
+	}
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Store keeps the bot state between webhooks and across restarts.
+// Values are JSON encoded and grouped in buckets.
+type Store interface {
+	// Get decodes the value stored under key into v and reports whether it was found.
+	Get(bucket string, key string, v interface{}) (bool, error)
+	Put(bucket string, key string, v interface{}) error
+	Delete(bucket string, key string) error
+	// ForEach calls fn for every key in the bucket, stopping at the first error.
+	ForEach(bucket string, fn func(key string, value []byte) error) error
+	// Ping checks that the store is still usable.
+	Ping() error
+	Close() error
+}
+
+// Buckets used by the bot
+const (
+	bucketMessages  = "messages"
+	bucketAlerts    = "alerts"
+	bucketAcks      = "acks"
+	bucketSilences  = "silences"
+	bucketCallbacks = "callbacks"
+	bucketChats     = "chats"
+	bucketQueue     = "queue"
+)
+
+var storeBuckets = []string{bucketMessages, bucketAlerts, bucketAcks, bucketSilences, bucketCallbacks, bucketChats, bucketQueue}
+
+// MessageRecord remembers which Telegram messages were sent for an
+// Alertmanager group, so later updates of the group can edit them.
+type MessageRecord struct {
+	ChatID     int64     `json:"chatId"`
+	TopicID    int64     `json:"topicId"`
+	GroupKey   string    `json:"groupKey"`
+	MessageIDs []int     `json:"messageIds"`
+	SentAt     time.Time `json:"sentAt"`
+}
+
+// AlertRecord is the last known state of a single alert in a chat.
+type AlertRecord struct {
+	Fingerprint string            `json:"fingerprint"`
+	ChatID      int64             `json:"chatId"`
+	TopicID     int64             `json:"topicId"`
+	Labels      map[string]string `json:"labels"`
+	Status      string            `json:"status"`
+	StartsAt    time.Time         `json:"startsAt"`
+	LastSentAt  time.Time         `json:"lastSentAt"`
+}
+
+// AckRecord is an acknowledgement of an alert group by a chat member.
+type AckRecord struct {
+	ChatID    int64     `json:"chatId"`
+	MessageID int       `json:"messageId"`
+	GroupKey  string    `json:"groupKey"`
+	UserID    int64     `json:"userId"`
+	UserName  string    `json:"userName"`
+	At        time.Time `json:"at"`
+}
+
+// SilenceRecord is a silence created in Alertmanager through the bot.
+type SilenceRecord struct {
+	ID        string            `json:"id"`
+	ChatID    int64             `json:"chatId"`
+	Matchers  map[string]string `json:"matchers"`
+	CreatedBy string            `json:"createdBy"`
+	StartsAt  time.Time         `json:"startsAt"`
+	EndsAt    time.Time         `json:"endsAt"`
+}
+
+func messageKey(chatid int64, topicid int64, groupKey string) string {
+	return fmt.Sprintf("%d/%d/%s", chatid, topicid, groupKey)
+}
+
+func alertKey(chat string, topicid int64, fingerprint string) string {
+	return fmt.Sprintf("%s/%d/%s", chat, topicid, fingerprint)
+}
+
+// labelsFingerprint hashes a label set the same way regardless of map order.
+func labelsFingerprint(labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	h := fnv.New64a()
+	for _, name := range names {
+		h.Write([]byte(name))
+		h.Write([]byte{0xff})
+		h.Write([]byte(labels[name]))
+		h.Write([]byte{0xff})
+	}
+	return fmt.Sprintf("%016x", h.Sum64())
+}
+
+// openStore creates the store selected by the storage section of the config.
+func openStore(backend string, path string) (Store, error) {
+	switch strings.ToLower(backend) {
+	case "bolt", "bbolt":
+		store, err := openBoltStore(path)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w (set storage.path to a writable file, or storage.backend to memory to lose the state on restart)", path, err)
+		}
+		return store, nil
+	case "memory":
+		return newMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+/******************************************************************************
+ *
+ *          Embedded bbolt store
+ *
+ ******************************************************************************/
+
+type boltStore struct {
+	db *bolt.DB
+}
+
+func openBoltStore(path string) (*boltStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range storeBuckets {
+			if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	slog.Info("Opened state store", "backend", "bolt", "path", path)
+
+	return &boltStore{db: db}, nil
+}
+
+func (s *boltStore) Get(bucket string, key string, v interface{}) (bool, error) {
+	var found bool
+	err := s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		value := b.Get([]byte(key))
+		if value == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(value, v)
+	})
+	return found, err
+}
+
+func (s *boltStore) Put(bucket string, key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(bucket))
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(key), value)
+	})
+}
+
+func (s *boltStore) Delete(bucket string, key string) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.Delete([]byte(key))
+	})
+}
+
+func (s *boltStore) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(bucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			return fn(string(k), v)
+		})
+	})
+}
+
+func (s *boltStore) Ping() error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket([]byte(bucketMessages)) == nil {
+			return errors.New("messages bucket is missing")
+		}
+		return nil
+	})
+}
+
+func (s *boltStore) Close() error {
+	return s.db.Close()
+}
+
+/******************************************************************************
+ *
+ *          In-memory store, state is lost on restart
+ *
+ ******************************************************************************/
+
+type memoryStore struct {
+	mu      sync.RWMutex
+	buckets map[string]map[string][]byte
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{buckets: make(map[string]map[string][]byte)}
+}
+
+func (s *memoryStore) Get(bucket string, key string, v interface{}) (bool, error) {
+	s.mu.RLock()
+	value, ok := s.buckets[bucket][key]
+	s.mu.RUnlock()
+	if !ok {
+		return false, nil
+	}
+	return true, json.Unmarshal(value, v)
+}
+
+func (s *memoryStore) Put(bucket string, key string, v interface{}) error {
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.buckets[bucket] == nil {
+		s.buckets[bucket] = make(map[string][]byte)
+	}
+	s.buckets[bucket][key] = value
+	return nil
+}
+
+func (s *memoryStore) Delete(bucket string, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.buckets[bucket], key)
+	return nil
+}
+
+func (s *memoryStore) ForEach(bucket string, fn func(key string, value []byte) error) error {
+	s.mu.RLock()
+	keys := make([]string, 0, len(s.buckets[bucket]))
+	for k := range s.buckets[bucket] {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	values := make([][]byte, len(keys))
+	for i, k := range keys {
+		values[i] = s.buckets[bucket][k]
+	}
+	s.mu.RUnlock()
+
+	for i, k := range keys {
+		if err := fn(k, values[i]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) Ping() error {
+	return nil
+}
+
+func (s *memoryStore) Close() error {
+	return nil
+}
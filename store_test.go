@@ -0,0 +1,68 @@
+package main
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestStores(t *testing.T) {
+	stores := map[string]func(t *testing.T) Store{
+		"memory": func(t *testing.T) Store { return newMemoryStore() },
+		"bolt": func(t *testing.T) Store {
+			s, err := openStore("bolt", filepath.Join(t.TempDir(), "state.db"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return s
+		},
+	}
+	for name, open := range stores {
+		t.Run(name, func(t *testing.T) {
+			s := open(t)
+			defer s.Close()
+
+			var rec AlertRecord
+			if found, err := s.Get(bucketAlerts, "missing", &rec); found || err != nil {
+				t.Errorf("Get(missing) = %v, %v, want false, nil", found, err)
+			}
+
+			for _, key := range []string{"b", "c", "a"} {
+				if err := s.Put(bucketAlerts, key, AlertRecord{Status: key}); err != nil {
+					t.Fatalf("Put(%s) = %v", key, err)
+				}
+			}
+			if found, err := s.Get(bucketAlerts, "b", &rec); !found || err != nil || rec.Status != "b" {
+				t.Errorf("Get(b) = %v, %v, %+v", found, err, rec)
+			}
+
+			if err := s.Delete(bucketAlerts, "c"); err != nil {
+				t.Fatalf("Delete(c) = %v", err)
+			}
+			var keys []string
+			err := s.ForEach(bucketAlerts, func(key string, value []byte) error {
+				keys = append(keys, key)
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("ForEach() = %v", err)
+			}
+			if want := []string{"a", "b"}; !reflect.DeepEqual(keys, want) {
+				t.Errorf("ForEach() keys = %v, want %v", keys, want)
+			}
+
+			if err := s.Ping(); err != nil {
+				t.Errorf("Ping() = %v", err)
+			}
+		})
+	}
+}
+
+func TestOpenStoreFailsLoudly(t *testing.T) {
+	if _, err := openStore("bolt", filepath.Join(t.TempDir(), "missing", "state.db")); err == nil {
+		t.Error("openStore() in a missing directory succeeded")
+	}
+	if _, err := openStore("redis", ""); err == nil {
+		t.Error("openStore() of an unknown backend succeeded")
+	}
+}
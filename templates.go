@@ -0,0 +1,134 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// loadTemplates parses the templates section of c. An entry is a file, or a
+// glob whose files are named after their base name without extension.
+func loadTemplates(c *Config) (map[string]*template.Template, error) {
+	var errs []error
+	templates := map[string]*template.Template{}
+	c.templateFiles = map[string]string{}
+
+	for name, pattern := range c.Templates {
+		// The files of a glob are named after themselves, name is only the entry
+		if !strings.ContainsAny(pattern, "*?[") {
+			c.templateFiles[name] = pattern
+			continue
+		}
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("template %q: %w", name, err))
+			continue
+		}
+		if len(files) == 0 {
+			errs = append(errs, fmt.Errorf("template %q: no file matches %s", name, pattern))
+		}
+		for _, file := range files {
+			base := filepath.Base(file)
+			c.templateFiles[strings.TrimSuffix(base, filepath.Ext(base))] = file
+		}
+	}
+
+	for name, file := range c.templateFiles {
+		if c.Templates[name] != "" && c.Templates[name] != file {
+			errs = append(errs, fmt.Errorf("template %q is defined twice, by name and by a glob", name))
+			continue
+		}
+		tmpl, err := parseTemplate(file)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("template %q: %w", name, err))
+			continue
+		}
+		templates[name] = tmpl
+	}
+	return templates, errors.Join(errs...)
+}
+
+// addTemplate makes the template of a route available, tmpl is the name of
+// a template or a file path.
+func addTemplate(c *Config, templates map[string]*template.Template, tmpl string) error {
+	if tmpl == "" || templates[tmpl] != nil {
+		return nil
+	}
+	parsed, err := parseTemplate(tmpl)
+	if err != nil {
+		return err
+	}
+	templates[tmpl] = parsed
+	c.templateFiles[tmpl] = tmpl
+	return nil
+}
+
+// templateName returns the template picked with the ?template= parameter,
+// it answers 400 when there is no such template.
+func templateName(c *gin.Context) (string, bool) {
+	name := c.Query("template")
+	if name == "" {
+		return "", true
+	}
+	if _, ok := current().templates[name]; !ok {
+		c.JSON(http.StatusBadRequest, gin.H{
+			"err": fmt.Sprintf("unknown template %q", name),
+		})
+		return "", false
+	}
+	return name, true
+}
+
+// AlertData is what the "alert" template gets: the alert, and the webhook
+// group it came in as .Group.
+type AlertData struct {
+	Alert
+	Group Alerts
+}
+
+// Message is the text of an alert group, or of a single alert. Err is the
+// template error when Text is in the standard format instead.
+type Message struct {
+	Alerts Alerts
+	Text   string
+	Err    error
+}
+
+// renderMessages formats alerts as one message, or as one message per alert
+// when per_alert_messages is set and the template defines "alert".
+func renderMessages(alerts Alerts, name string) []Message {
+	cfg := current().cfg
+	// Selected once, in debug mode it is read again from disk
+	tmpl := selectTemplate(alerts, name)
+	if !cfg.PerAlertMessages || tmpl == nil || tmpl.Lookup("alert") == nil {
+		text, err := formatAlerts(alerts, tmpl)
+		return []Message{{alerts, text, err}}
+	}
+
+	messages := make([]Message, 0, len(alerts.Alerts))
+	for _, alert := range alerts.Alerts {
+		single := singleAlert(alerts, alert)
+		text, err := runTemplate(tmpl, "alert", AlertData{Alert: alert, Group: alerts}, single)
+		messages = append(messages, Message{single, text, err})
+	}
+	return messages
+}
+
+// singleAlert makes a group of one alert. It has its own group key, so its
+// message is edited apart from the other alerts of the group.
+func singleAlert(alerts Alerts, alert Alert) Alerts {
+	single := alerts
+	single.Alerts = []Alert{alert}
+	single.Status = alert.Status
+	single.CommonLabels = alert.Labels
+	single.CommonAnnotations = alert.Annotations
+	if alerts.GroupKey != "" {
+		single.GroupKey = alerts.GroupKey + "/" + alert.fingerprint()
+	}
+	return single
+}
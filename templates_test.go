@@ -0,0 +1,101 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestLoadTemplatesGlob(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, dir, "db.tmpl", "db {{ .Status }}")
+	writeFile(t, dir, "infra.tmpl", "infra {{ .Status }}")
+	business := writeFile(t, t.TempDir(), "business.tmpl", "business")
+
+	c := &Config{Templates: map[string]string{
+		"teams":    filepath.Join(dir, "*.tmpl"),
+		"business": business,
+	}}
+	templates, err := loadTemplates(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	// The key of the glob entry is not a template
+	if got := strings.Join(names, ","); got != "business,db,infra" {
+		t.Errorf("templates = %s, want business,db,infra", got)
+	}
+
+	c.Templates["empty"] = filepath.Join(dir, "*.missing")
+	if _, err := loadTemplates(c); err == nil {
+		t.Error("loadTemplates() with a glob matching nothing succeeded")
+	}
+}
+
+func TestRenderMessages(t *testing.T) {
+	dir := t.TempDir()
+	file := writeFile(t, dir, "short.tmpl", `{{ define "alert" }}one {{ .Labels.alertname }}{{ end }}group {{ len .Alerts }}`)
+	both := writeFile(t, dir, "both.tmpl", `{{ define "firing" }}fire {{ len .Alerts }}{{ end }}{{ define "resolved" }}calm {{ len .Alerts }}{{ end }}body`)
+	firing := writeFile(t, dir, "firing.tmpl", `{{ define "firing" }}fire {{ len .Alerts }}{{ end }}body {{ .Status }}`)
+	cfg := useConfig(&Config{Templates: map[string]string{"short": file, "both": both, "firing": firing}})
+	templates, err := loadTemplates(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	running.Store(&snapshot{cfg: cfg, templates: templates})
+
+	alerts := Alerts{Status: "firing", GroupKey: "g", Alerts: []Alert{
+		{Status: "firing", Labels: map[string]string{"alertname": "A"}},
+		{Status: "firing", Labels: map[string]string{"alertname": "B"}},
+	}}
+	texts := func(messages []Message) string {
+		var res []string
+		for _, m := range messages {
+			if m.Err != nil {
+				t.Errorf("render error: %v", m.Err)
+			}
+			res = append(res, m.Text)
+		}
+		return strings.Join(res, "|")
+	}
+
+	if got := texts(renderMessages(alerts, "short")); got != "group 2" {
+		t.Errorf("renderMessages() = %q, want %q", got, "group 2")
+	}
+
+	// A template named after the group status replaces the body
+	resolved := alerts
+	resolved.Status = "resolved"
+	for _, tt := range []struct {
+		name   string
+		alerts Alerts
+		want   string
+	}{
+		{"both", alerts, "fire 2"},
+		{"both", resolved, "calm 2"},
+		{"firing", alerts, "fire 2"},
+		{"firing", resolved, "body resolved"},
+	} {
+		if got := texts(renderMessages(tt.alerts, tt.name)); got != tt.want {
+			t.Errorf("renderMessages(%s, %s) = %q, want %q", tt.alerts.Status, tt.name, got, tt.want)
+		}
+	}
+
+	cfg.PerAlertMessages = true
+	if got := texts(renderMessages(alerts, "short")); got != "one A|one B" {
+		t.Errorf("renderMessages() per alert = %q, want %q", got, "one A|one B")
+	}
+
+	// In debug mode the file is read again
+	writeFile(t, dir, "short.tmpl", `{{ define "alert" }}edited {{ .Labels.alertname }}{{ end }}`)
+	*debug = true
+	defer func() { *debug = false }()
+	if got := texts(renderMessages(alerts, "short")); got != "edited A|edited B" {
+		t.Errorf("renderMessages() in debug mode = %q, want %q", got, "edited A|edited B")
+	}
+}
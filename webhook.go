@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Version of the Alertmanager webhook payload the bot understands
+const webhookVersion = "4"
+
+// PayloadProblem is a field of a webhook that doesn't follow the format of
+// its source.
+type PayloadProblem struct {
+	Field   string `json:"field"`
+	Message string `json:"error"`
+}
+
+func (p PayloadProblem) Error() string {
+	return p.Field + ": " + p.Message
+}
+
+// limitBody reads the body of webhooks up to max_body_bytes, it answers 413
+// for larger ones. The body is kept in memory for the signature check and
+// the handler.
+func limitBody(c *gin.Context) {
+	cfg := current().cfg
+	body, err := io.ReadAll(http.MaxBytesReader(c.Writer, c.Request.Body, cfg.MaxBodyBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			rejectWebhook(c, http.StatusRequestEntityTooLarge, "too_large", fmt.Sprintf("body larger than %d bytes", tooLarge.Limit), nil)
+		} else {
+			rejectWebhook(c, http.StatusBadRequest, "unreadable", fmt.Sprint(err), nil)
+		}
+		return
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+}
+
+// readAlerts decodes the webhook of the request with the input adapter of
+// its route and checks the alerts, it answers 400 when they are not valid.
+func readAlerts(c *gin.Context) (Alerts, bool) {
+	alerts, err := inputAdapter(c)(c.Request.Body)
+	var problem PayloadProblem
+	if errors.As(err, &problem) {
+		rejectWebhook(c, http.StatusBadRequest, "invalid_payload", "not a valid webhook", []PayloadProblem{problem})
+		return alerts, false
+	} else if err != nil {
+		rejectWebhook(c, http.StatusBadRequest, "invalid_json", "invalid JSON: "+jsonError(err), nil)
+		return alerts, false
+	}
+	if problems := validateAlerts(alerts); len(problems) > 0 {
+		rejectWebhook(c, http.StatusBadRequest, "invalid_payload", "not a valid webhook", problems)
+		return alerts, false
+	}
+	return alerts, true
+}
+
+// jsonError describes a decoding error with the field or offset it is at.
+func jsonError(err error) string {
+	var typeErr *json.UnmarshalTypeError
+	var syntaxErr *json.SyntaxError
+	var timeErr *time.ParseError
+	switch {
+	case errors.As(err, &timeErr):
+		return fmt.Sprintf("not an RFC 3339 time: %s", timeErr.Value)
+	case errors.As(err, &typeErr):
+		return fmt.Sprintf("%s must be %s, not %s", typeErr.Field, typeErr.Type, typeErr.Value)
+	case errors.As(err, &syntaxErr):
+		return fmt.Sprintf("%v at byte %d", err, syntaxErr.Offset)
+	case errors.Is(err, io.EOF):
+		return "empty body"
+	}
+	return err.Error()
+}
+
+// validateAlerts checks alerts against the Alertmanager webhook format.
+func validateAlerts(alerts Alerts) []PayloadProblem {
+	var problems []PayloadProblem
+	problem := func(field, format string, args ...any) {
+		problems = append(problems, PayloadProblem{field, fmt.Sprintf(format, args...)})
+	}
+
+	if alerts.Version != "" && alerts.Version != webhookVersion {
+		problem("version", "%q is not supported, only %q", alerts.Version, webhookVersion)
+	}
+	if !validStatus(alerts.Status) {
+		problem("status", "must be firing or resolved, not %q", alerts.Status)
+	}
+	if len(alerts.Alerts) == 0 {
+		problem("alerts", "no alerts")
+	}
+	for i, alert := range alerts.Alerts {
+		field := fmt.Sprintf("alerts[%d]", i)
+		if alert.Status != "" && !validStatus(alert.Status) {
+			problem(field+".status", "must be firing or resolved, not %q", alert.Status)
+		}
+		if alert.StartsAt.IsZero() {
+			problem(field+".startsAt", "missing")
+		}
+	}
+	return problems
+}
+
+func validStatus(status string) bool {
+	return status == "firing" || status == "resolved"
+}
+
+// rejectWebhook answers a webhook that can't be handled with the reason and
+// the problems found in the payload.
+func rejectWebhook(c *gin.Context, code int, reason string, message string, problems []PayloadProblem) {
+	webhooksRejected.WithLabelValues(reason).Inc()
+	slog.Warn("Rejected webhook", "path", c.Request.URL.Path, "reason", reason, "error", message, "problems", problems, "remote", c.ClientIP())
+
+	response := gin.H{
+		"err": message,
+	}
+	if len(problems) > 0 {
+		response["problems"] = problems
+	}
+	c.AbortWithStatusJSON(code, response)
+}
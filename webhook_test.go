@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestReadAlerts(t *testing.T) {
+	useConfig(&Config{MaxBodyBytes: 512})
+
+	router := gin.New()
+	handler := func(c *gin.Context) {
+		if _, ok := readAlerts(c); ok {
+			c.String(http.StatusOK, "ok")
+		}
+	}
+	router.POST("/alert/:chatid", limitBody, handler)
+	router.POST("/generic/:chatid", limitBody, handler)
+
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+		// Part of the response
+		err string
+	}{
+		{
+			name: "valid",
+			path: "/alert/1",
+			body: `{"version": "4", "status": "firing", "alerts": [{"status": "firing", "startsAt": "2024-01-01T00:00:00Z"}]}`,
+			want: 200,
+		},
+		{name: "empty body", path: "/alert/1", body: "", want: 400, err: "empty body"},
+		{name: "syntax error", path: "/alert/1", body: `{"status": `, want: 400, err: "invalid JSON"},
+		{name: "wrong type", path: "/alert/1", body: `{"status": 1}`, want: 400, err: "status must be string"},
+		{name: "bad time", path: "/alert/1", body: `{"alerts": [{"startsAt": "yesterday"}]}`, want: 400, err: "not an RFC 3339 time"},
+		{
+			name: "unsupported version",
+			path: "/alert/1",
+			body: `{"version": "3", "status": "firing", "alerts": [{"startsAt": "2024-01-01T00:00:00Z"}]}`,
+			want: 400,
+			err:  `"field":"version"`,
+		},
+		{name: "bad status", path: "/alert/1", body: `{"status": "burning", "alerts": [{"startsAt": "2024-01-01T00:00:00Z"}]}`, want: 400, err: `"field":"status"`},
+		{name: "no alerts", path: "/alert/1", body: `{"status": "firing", "alerts": []}`, want: 400, err: "no alerts"},
+		{name: "missing startsAt", path: "/alert/1", body: `{"status": "firing", "alerts": [{}]}`, want: 400, err: `alerts[0].startsAt`},
+		{name: "bad alert status", path: "/alert/1", body: `{"status": "firing", "alerts": [{"status": "x", "startsAt": "2024-01-01T00:00:00Z"}]}`, want: 400, err: "alerts[0].status"},
+		{name: "too large", path: "/alert/1", body: `{"status": "` + strings.Repeat("x", 600) + `"}`, want: 413, err: "larger than 512 bytes"},
+		{name: "generic adapter", path: "/generic/1", body: `{"title": "Backup failed"}`, want: 200},
+		{name: "generic without title", path: "/generic/1", body: `{"message": "?"}`, want: 400, err: `"field":"title"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(tt.body)))
+			if w.Code != tt.want {
+				t.Errorf("POST %s = %d %s, want %d", tt.path, w.Code, w.Body, tt.want)
+			}
+			if !strings.Contains(w.Body.String(), tt.err) {
+				t.Errorf("POST %s = %s, want %s in it", tt.path, w.Body, tt.err)
+			}
+		})
+	}
+}
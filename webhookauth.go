@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// WebhookAuth is how senders of webhooks authenticate. With a bearer token
+// and basic auth, either one is accepted. The HMAC signature is checked on
+// top of them.
+type WebhookAuth struct {
+	BearerToken string `yaml:"bearer_token"`
+	Username    string `yaml:"username"`
+	Password    string `yaml:"password"`
+	// HMAC-SHA256 of the body in hex, optionally prefixed with sha256=
+	HMACSecret string `yaml:"hmac_secret"`
+	HMACHeader string `yaml:"hmac_header"`
+}
+
+func (a *WebhookAuth) enabled() bool {
+	return a != nil && (a.BearerToken != "" || a.Username != "" || a.HMACSecret != "")
+}
+
+// chatWebhookAuths returns the authentication of a chat: the webhook_auth
+// of its aliases, found by chat ID so /alert/<id> can't skip the one of
+// /alert/<alias>, or the global one. An empty webhook_auth keeps the global one.
+func chatWebhookAuths(cfg *Config, chatid int64, notifier string) []*WebhookAuth {
+	var auths []*WebhookAuth
+	for name, alias := range cfg.Chats {
+		same := name == notifier
+		if notifier == "" {
+			same = alias.Notifier == nil && migratedChatID(alias.ID) == chatid
+		}
+		if same && alias.WebhookAuth.enabled() {
+			auths = append(auths, alias.WebhookAuth)
+		}
+	}
+	if len(auths) == 0 {
+		auths = append(auths, &cfg.WebhookAuth)
+	}
+	return auths
+}
+
+// webhookAuthsFor returns the authentications a request must pass all of:
+// those of the chat of its path, or the global one for /alert, which the
+// routing rules of the configuration send on.
+func webhookAuthsFor(c *gin.Context) []*WebhookAuth {
+	cfg := current().cfg
+	chat := c.Param("chatid")
+	if chat == "" {
+		return []*WebhookAuth{&cfg.WebhookAuth}
+	}
+
+	chatid, _, err := resolveChat(chat)
+	if err != nil {
+		// Answered 400 by the handler, unless the global authentication fails first
+		return []*WebhookAuth{&cfg.WebhookAuth}
+	}
+	return chatWebhookAuths(cfg, chatid, chatNotifier(chat))
+}
+
+// authenticateWebhook rejects webhooks that don't carry the configured
+// credentials or signature.
+func authenticateWebhook(c *gin.Context) {
+	var auth *WebhookAuth
+	reason := ""
+	for _, auth = range webhookAuthsFor(c) {
+		if !auth.enabled() {
+			continue
+		}
+		switch {
+		case !auth.checkCredentials(c.Request):
+			reason = "credentials"
+		case !auth.checkSignature(c):
+			reason = "signature"
+		}
+		if reason != "" {
+			break
+		}
+	}
+	if reason == "" {
+		return
+	}
+
+	webhookAuthFailures.WithLabelValues(reason).Inc()
+	slog.Warn("Unauthorized webhook", "path", c.Request.URL.Path, "reason", reason, "remote", c.ClientIP())
+	if auth.Username != "" {
+		c.Header("WWW-Authenticate", `Basic realm="prometheus_bot"`)
+	}
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{
+		"err": "invalid " + reason,
+	})
+}
+
+func (a *WebhookAuth) checkCredentials(r *http.Request) bool {
+	if a.BearerToken == "" && a.Username == "" {
+		return true
+	}
+	if a.BearerToken != "" {
+		header := r.Header.Get("Authorization")
+		if subtle.ConstantTimeCompare([]byte(header), []byte("Bearer "+a.BearerToken)) == 1 {
+			return true
+		}
+	}
+	if a.Username != "" {
+		username, password, ok := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(username), []byte(a.Username)) == 1
+		passwordOK := subtle.ConstantTimeCompare([]byte(password), []byte(a.Password)) == 1
+		if ok && userOK && passwordOK {
+			return true
+		}
+	}
+	return false
+}
+
+// checkSignature verifies the HMAC of the body, which is put back for the
+// handler.
+func (a *WebhookAuth) checkSignature(c *gin.Context) bool {
+	if a.HMACSecret == "" {
+		return true
+	}
+	signature, err := hex.DecodeString(strings.TrimPrefix(c.GetHeader(a.HMACHeader), "sha256="))
+	if err != nil || len(signature) == 0 {
+		return false
+	}
+
+	body, err := io.ReadAll(c.Request.Body)
+	if err != nil {
+		return false
+	}
+	c.Request.Body = io.NopCloser(bytes.NewReader(body))
+
+	mac := hmac.New(sha256.New, []byte(a.HMACSecret))
+	mac.Write(body)
+	return hmac.Equal(signature, mac.Sum(nil))
+}
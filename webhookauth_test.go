@@ -0,0 +1,99 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAuthenticateWebhook(t *testing.T) {
+	cfg := useConfig(&Config{
+		WebhookAuth: WebhookAuth{BearerToken: "global"},
+		Chats: map[string]ChatConfig{
+			"oncall": {ID: -100, WebhookAuth: &WebhookAuth{BearerToken: "oncall"}},
+			"team":   {ID: -200, WebhookAuth: &WebhookAuth{}},
+			"signed": {ID: -300, WebhookAuth: &WebhookAuth{HMACSecret: "s3cret"}},
+		},
+	})
+	setDefaults(cfg)
+
+	router := gin.New()
+	ok := func(c *gin.Context) { c.String(http.StatusOK, "ok") }
+	router.POST("/alert", authenticateWebhook, ok)
+	router.POST("/alert/:chatid", authenticateWebhook, ok)
+
+	body := `{"status": "firing"}`
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(body))
+	signature := "sha256=" + hex.EncodeToString(mac.Sum(nil))
+
+	tests := []struct {
+		name    string
+		path    string
+		routes  []Route
+		token   string
+		headers map[string]string
+		want    int
+	}{
+		{name: "global without token", path: "/alert/-999", want: 401},
+		{name: "global", path: "/alert/-999", token: "global", want: 200},
+		{name: "alias", path: "/alert/oncall", token: "oncall", want: 200},
+		{name: "alias with the global token", path: "/alert/oncall", token: "global", want: 401},
+		{name: "chat ID of an alias", path: "/alert/-100", token: "global", want: 401},
+		{name: "chat ID of an alias, its token", path: "/alert/-100", token: "oncall", want: 200},
+		{name: "empty block inherits", path: "/alert/team", want: 401},
+		{name: "empty block inherits, global token", path: "/alert/team", token: "global", want: 200},
+		{name: "signature", path: "/alert/signed", headers: map[string]string{"X-Signature": signature}, want: 200},
+		{name: "bad signature", path: "/alert/signed", headers: map[string]string{"X-Signature": "sha256=00"}, want: 401},
+		{
+			name:   "routed to an alias",
+			path:   "/alert",
+			routes: []Route{{Targets: []RouteTarget{{Chat: "oncall"}}}},
+			token:  "global",
+			want:   200,
+		},
+		{
+			name:   "routed to an alias, its token",
+			path:   "/alert",
+			routes: []Route{{Targets: []RouteTarget{{Chat: "oncall"}}}},
+			token:  "oncall",
+			want:   401,
+		},
+		{
+			name:   "routed to aliases with different tokens",
+			path:   "/alert",
+			routes: []Route{{Targets: []RouteTarget{{Chat: "oncall"}, {Chat: "signed"}}, Routes: []Route{{Targets: []RouteTarget{{ChatID: -999}}}}}},
+			token:  "global",
+			want:   200,
+		},
+		{name: "routed without routes", path: "/alert", token: "global", want: 200},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg.Routes = tt.routes
+			cfg.templateFiles = map[string]string{}
+			if err := prepareRoutes(cfg.Routes, cfg, nil); err != nil {
+				t.Fatal(err)
+			}
+
+			req := httptest.NewRequest(http.MethodPost, tt.path, strings.NewReader(body))
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("POST %s = %d, want %d", tt.path, w.Code, tt.want)
+			}
+		})
+	}
+}